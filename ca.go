@@ -70,6 +70,9 @@ func init() {
 }
 
 func cmdCAPersistentPreRun(cmd *cobra.Command, args []string) {
+	// This replaces the persistent pre-run of the main command
+	setLogLevel(globalFlags.logLevel)
+	enableStateFile(cmd.Flags().Changed("state-dir"))
 	if caFlags.clusterID == "" && caFlags.clusterIDFile != "" {
 		raw, err := ioutil.ReadFile(caFlags.clusterIDFile)
 		if err != nil {
@@ -66,12 +66,18 @@ func init() {
 	cmdCAIssue.PersistentFlags().StringVar(&caIssueFlags.KeyFileName, "key-file-name", caIssueFlags.KeyFileName, "Filename of the private key")
 	cmdCAIssue.PersistentFlags().StringVar(&caIssueFlags.CAFileName, "ca-file-name", caIssueFlags.CAFileName, "Filename of the CA certificate")
 	cmdCAIssue.PersistentFlags().Uint32Var(&caIssueFlags.FileMode, "file-mode", caIssueFlags.FileMode, "Mode of files that are created (defaults to 0600)")
+	cmdCAIssue.PersistentFlags().StringVar(&caIssueFlags.Owner, "owner", "", "Name or uid of the owner of files that are created")
+	cmdCAIssue.PersistentFlags().StringVar(&caIssueFlags.Group, "group", "", "Name or gid of the group of files that are created")
+	cmdCAIssue.PersistentFlags().BoolVar(&caIssueFlags.AllowPersistent, "allow-persistent", false, "If set, files may be written to a filesystem other than tmpfs or ramfs")
+	cmdCAIssue.PersistentFlags().BoolVar(&caIssueFlags.RequireTmpfs, "require-tmpfs", false, "If set, files must be written to tmpfs or ramfs")
+	addChangeHookFlags(cmdCAIssue.PersistentFlags())
 }
 
 func cmdCAIssueETCDRun(cmd *cobra.Command, args []string) {
 	assertArgIsSet(caFlags.clusterID, "cluster-id")
 	assertArgIsSet(caIssueFlags.OutputDir, "destination")
 	assertArgIsSet(caIssueFlags.CommonName, "common-name")
+	hook := mustGetChangeHook()
 
 	caIssueFlags.IssueConfig.SetupDefaults(caFlags.clusterID)
 	if !caIssueFlags.force {
@@ -96,15 +102,18 @@ func cmdCAIssueETCDRun(cmd *cobra.Command, args []string) {
 	}
 
 	ca := c.CA()
-	if err := ca.IssueETCDCertificate(caFlags.clusterID, caIssueFlags.IssueConfig); err != nil {
+	changed, err := ca.IssueETCDCertificate(caFlags.clusterID, caIssueFlags.IssueConfig)
+	if err != nil {
 		Exitf("Failed to issue certificate: %v", err)
 	}
+	runChangeHook(hook, changed)
 }
 
 func cmdCAIssueK8sRun(cmd *cobra.Command, args []string) {
 	assertArgIsSet(caFlags.clusterID, "cluster-id")
 	assertArgIsSet(caIssueFlags.OutputDir, "destination")
 	assertArgIsSet(caIssueFlags.CommonName, "common-name")
+	hook := mustGetChangeHook()
 
 	caIssueFlags.IssueConfig.SetupDefaults(caFlags.clusterID)
 	if !caIssueFlags.force {
@@ -129,7 +138,9 @@ func cmdCAIssueK8sRun(cmd *cobra.Command, args []string) {
 	}
 
 	ca := c.CA()
-	if err := ca.IssueK8sCertificate(caFlags.clusterID, caIssueFlags.IssueConfig); err != nil {
+	changed, err := ca.IssueK8sCertificate(caFlags.clusterID, caIssueFlags.IssueConfig)
+	if err != nil {
 		Exitf("Failed to issue certificate: %v", err)
 	}
+	runChangeHook(hook, changed)
 }
@@ -0,0 +1,60 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+var (
+	cmdCleanup = &cobra.Command{
+		Use:   "cleanup",
+		Short: "Securely remove all files and kubernetes secret keys written by previous extractions",
+		Run:   cmdCleanupRun,
+	}
+)
+
+func init() {
+	addKubernetesClientFlags(cmdCleanup.Flags())
+	cmdMain.AddCommand(cmdCleanup)
+}
+
+func cmdCleanupRun(cmd *cobra.Command, args []string) {
+	if len(args) != 0 {
+		Exitf("No arguments expected")
+	}
+	if stateFileErr != nil {
+		Exitf("Cannot use state directory: %v", stateFileErr)
+	}
+	state, err := service.LoadState()
+	if err != nil {
+		Exitf("Cannot load state: %v", err)
+	}
+	if state.IsEmpty() {
+		log.Infof("Nothing to clean up")
+		return
+	}
+	var k8sclient *service.K8sClient
+	if len(state.KubernetesSecrets) > 0 || len(state.KubernetesConfigMaps) > 0 {
+		if k8sclient, err = newKubernetesClient(); err != nil {
+			Exitf("Cannot create kubernetes client: %v", err)
+		}
+	}
+	if err := service.Cleanup(log, k8sclient); err != nil {
+		Exitf("Cleanup failed: %v", err)
+	}
+}
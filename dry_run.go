@@ -0,0 +1,92 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+const (
+	dryRunFormatTable = "table"
+	dryRunFormatJSON  = "json"
+)
+
+var (
+	dryRunFlags struct {
+		enabled bool
+		format  string
+	}
+)
+
+// addDryRunFlags adds the flags used to check access to secrets without extracting them to the given commands.
+func addDryRunFlags(cmds ...*cobra.Command) {
+	for _, cmd := range cmds {
+		cmd.Flags().BoolVar(&dryRunFlags.enabled, "dry-run", false, "If set, only check that all secrets can be read (after a full login) and report the results, without writing any target")
+		cmd.Flags().StringVar(&dryRunFlags.format, "dry-run-format", dryRunFormatTable, "Format of the --dry-run report (table|json)")
+	}
+}
+
+// assertDryRunFormatValid exits when --dry-run is set with an unknown --dry-run-format.
+func assertDryRunFormatValid() {
+	if dryRunFlags.enabled && dryRunFlags.format != dryRunFormatTable && dryRunFlags.format != dryRunFormatJSON {
+		Exitf("Invalid --dry-run-format '%s', expected table or json", dryRunFlags.format)
+	}
+}
+
+// reportAccessChecks prints the given checks to stdout.
+// It returns false if any of the secrets cannot be extracted.
+func reportAccessChecks(c *service.AuthenticatedVaultClient, checks []service.AccessCheck) bool {
+	// Reading dynamic secrets issues credentials that are never used
+	c.RevokeLeases()
+
+	switch dryRunFlags.format {
+	case dryRunFormatJSON:
+		encoded, err := json.MarshalIndent(checks, "", "  ")
+		if err != nil {
+			Exitf("Cannot encode report: %v", err)
+		}
+		fmt.Println(string(encoded))
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TARGET\tPATH\tFIELD\tCAPABILITIES\tSTATUS\tMESSAGE")
+		for _, check := range checks {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", check.Target, check.Path, check.Field, strings.Join(check.Capabilities, ","), check.Status, check.Message)
+		}
+		w.Flush()
+	}
+
+	for _, check := range checks {
+		if !check.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// exitDryRun exits with a non-zero exit code if the given report of reportAccessChecks failed.
+func exitDryRun(ok bool) {
+	if !ok {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
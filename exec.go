@@ -0,0 +1,108 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+const (
+	onChangeRestart = "restart"
+)
+
+var (
+	cmdExec = &cobra.Command{
+		Use:     "exec",
+		Short:   "Run a command with secrets in its environment.",
+		Example: "--env <environment-key>=<secret-path>[#<secret-field>]... -- <command> [argument]...",
+		Run:     cmdExecRun,
+	}
+
+	execFlags struct {
+		env          []string
+		onChange     string
+		interval     time.Duration
+		revokeLeases bool
+	}
+)
+
+func init() {
+	cmdExec.Flags().SetInterspersed(false)
+	cmdExec.Flags().StringArrayVar(&execFlags.env, "env", nil, "Secret to add to the environment of the command: <key>=<path>[#field]")
+	cmdExec.Flags().StringVar(&execFlags.onChange, "on-change", "", "What to do when a secret has changed: 'restart' or the name of a signal to send (e.g. SIGHUP). If not set, secrets are not watched")
+	cmdExec.Flags().DurationVar(&execFlags.interval, "interval", defaultWatchInterval, "Maximum time between 2 checks for changed secrets (with --on-change) or 2 lease renewals")
+	cmdExec.Flags().BoolVar(&execFlags.revokeLeases, "revoke-leases", true, "If set, the leases of dynamic secrets are revoked when the command has terminated")
+	addEnvFlags(cmdExec)
+	addServerLoginFlags(cmdExec.Flags())
+	cmdMain.AddCommand(cmdExec)
+}
+
+func cmdExecRun(cmd *cobra.Command, args []string) {
+	// Check arguments
+	if len(args) == 0 {
+		Exitf("Provide a command to run: -- <command> [argument]...")
+	}
+	if len(execFlags.env) == 0 {
+		Exitf("Provide at least one --env <key>=<path>[#field]")
+	}
+
+	// Parse arguments
+	secrets := []service.EnvSecret{}
+	for _, arg := range execFlags.env {
+		secret, err := parseEnvSecret(arg)
+		if err != nil {
+			Exitf(err.Error())
+		}
+		secrets = append(secrets, secret)
+	}
+	config := service.ExecConfig{
+		Secrets:      secrets,
+		Command:      args[0],
+		Args:         args[1:],
+		Interval:     execFlags.interval,
+		RevokeLeases: execFlags.revokeLeases,
+	}
+	switch execFlags.onChange {
+	case "":
+		// Do not watch
+	case onChangeRestart:
+		config.RestartOnChange = true
+	default:
+		sig, err := service.ParseSignal(execFlags.onChange)
+		if err != nil {
+			Exitf("Invalid --on-change: %v", err)
+		}
+		config.ChangeSignal = sig
+	}
+	if config.Interval <= 0 {
+		Exitf("--interval must be positive")
+	}
+
+	login, _, err := prepareServerLogin()
+	if err != nil {
+		Exitf("Login preparation failed: %#v", err)
+	}
+
+	code, err := service.Exec(log, login, config)
+	if err != nil {
+		Exitf("Failed to run %s: %v", config.Command, err)
+	}
+	os.Exit(code)
+}
@@ -16,8 +16,10 @@ package main
 
 import (
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 
 	"github.com/pulcy/vault-monkey/service"
 )
@@ -38,52 +40,144 @@ var (
 
 	extractFlags struct {
 		targetFilePath           string
+		kubeConfig               string
+		k8sContext               string
+		k8sNamespace             string
 		k8sPodIP                 string
+		k8sNodeName              string
 		k8sPodName               string
 		k8sClusterInfoSecretName string
 		k8sClusterIDSecretKey    string
 		k8sSecretName            string
 		k8sSecretKey             string
+		k8sSecretType            string
+		k8sSecretLabels          []string
+		k8sSecretAnnotations     []string
+		k8sSecretOwner           string
+		k8sConfigMapName         string
+		k8sConfigMapKey          string
 		jobID                    string
 		clusterIDPath            string
 		machineIDPath            string
+		wrapTTL                  string
 	}
 )
 
 func init() {
-	hostName := os.Getenv("HOSTNAME")
 	cmdExtract.PersistentFlags().StringVar(&extractFlags.targetFilePath, "target", "", "Path of target file")
-	cmdExtract.PersistentFlags().StringVar(&extractFlags.k8sPodName, "kubernetes-pod-name", hostName, "Name of Kubernetes pod this process is running in")
-	cmdExtract.PersistentFlags().StringVar(&extractFlags.k8sPodIP, "kubernetes-pod-ip", "", "IP address of Kubernetes pod (uses with hostNetwork=true)")
-	cmdExtract.PersistentFlags().StringVar(&extractFlags.k8sClusterInfoSecretName, "kubernetes-cluster-info-secret-name", defaultK8sClusterInfoSecretName, "Name of Kubernetes secret that holds the cluster ID")
-	cmdExtract.PersistentFlags().StringVar(&extractFlags.k8sClusterIDSecretKey, "kubernetes-cluster-id-secret-key", defaultK8sClusterIDSecretKey, "Key for the cluster ID secret identified by `kubernetes-cluster-info-secret-name`")
 	cmdExtract.PersistentFlags().StringVar(&extractFlags.k8sSecretName, "kubernetes-secret-name", "", "Name of Kubernetes secret to store extracted data into")
 	cmdExtract.PersistentFlags().StringVar(&extractFlags.k8sSecretKey, "kubernetes-secret-key", "", "Key inside Kubernetes secret to store extracted data into")
-	cmdExtract.PersistentFlags().StringVar(&extractFlags.jobID, "job-id", "", "Identifier for the current job")
-	cmdExtract.PersistentFlags().StringVar(&extractFlags.clusterIDPath, "cluster-id-path", defaultClusterIDPath, "Path of cluster-id file")
-	cmdExtract.PersistentFlags().StringVar(&extractFlags.machineIDPath, "machine-id-path", defaultMachineIDPath, "Path of machine-id file")
+	cmdExtract.PersistentFlags().StringVar(&extractFlags.k8sSecretType, "kubernetes-secret-type", "", "Type of the Kubernetes secret (Opaque|kubernetes.io/tls|kubernetes.io/dockerconfigjson|kubernetes.io/basic-auth)")
+	cmdExtract.PersistentFlags().StringArrayVar(&extractFlags.k8sSecretLabels, "kubernetes-secret-label", nil, "Label (<key>=<value>) to add to the Kubernetes secret")
+	cmdExtract.PersistentFlags().StringArrayVar(&extractFlags.k8sSecretAnnotations, "kubernetes-secret-annotation", nil, "Annotation (<key>=<value>) to add to the Kubernetes secret")
+	cmdExtract.PersistentFlags().StringVar(&extractFlags.k8sConfigMapName, "kubernetes-configmap-name", "", "Name of Kubernetes config map to store extracted (non-sensitive) data into")
+	cmdExtract.PersistentFlags().StringVar(&extractFlags.k8sConfigMapKey, "kubernetes-configmap-key", "", "Key inside Kubernetes config map to store extracted data into")
+	cmdExtract.PersistentFlags().StringVar(&extractFlags.k8sSecretOwner, "kubernetes-secret-owner", "", "If set, the Kubernetes secret is garbage collected with the pod or deployment vault-monkey is running in (pod|deployment)")
+	addServerLoginFlags(cmdExtract.PersistentFlags())
+	addChangeHookFlags(cmdExtract.PersistentFlags())
+	addFileOptionsFlags(cmdExtract.PersistentFlags())
+	addWrapFlags(cmdExtractEnv, cmdExtractFile)
+	addDryRunFlags(cmdExtractEnv, cmdExtractFile, cmdExtractApply, cmdExtractDir, cmdExtractTemplate)
 	cmdMain.AddCommand(cmdExtract)
 }
 
+// addServerLoginFlags adds the flags used by a server login to the given flag set.
+func addServerLoginFlags(flags *pflag.FlagSet) {
+	addKubernetesClientFlags(flags)
+	flags.StringVar(&extractFlags.jobID, "job-id", "", "Identifier for the current job")
+	flags.StringVar(&extractFlags.clusterIDPath, "cluster-id-path", defaultClusterIDPath, "Path of cluster-id file")
+	flags.StringVar(&extractFlags.machineIDPath, "machine-id-path", defaultMachineIDPath, "Path of machine-id file")
+}
+
+// addKubernetesClientFlags adds the flags used to create a kubernetes client to the given flag set.
+func addKubernetesClientFlags(flags *pflag.FlagSet) {
+	hostName := os.Getenv("HOSTNAME")
+	flags.StringVar(&extractFlags.kubeConfig, "kubeconfig", "", "Path of a kubeconfig file, used to access Kubernetes from outside the cluster")
+	flags.StringVar(&extractFlags.k8sContext, "kubernetes-context", "", "Context of the kubeconfig file to use (defaults to its current context)")
+	flags.StringVar(&extractFlags.k8sNamespace, "kubernetes-namespace", "", "Kubernetes namespace to use (defaults to the namespace of the pod or kubeconfig context)")
+	flags.StringVar(&extractFlags.k8sNodeName, "kubernetes-node-name", "", "Name of Kubernetes node this process is running on (use the downward API field spec.nodeName)")
+	flags.StringVar(&extractFlags.k8sPodName, "kubernetes-pod-name", hostName, "Name of Kubernetes pod this process is running in")
+	flags.StringVar(&extractFlags.k8sPodIP, "kubernetes-pod-ip", "", "IP address of Kubernetes pod (uses with hostNetwork=true)")
+	flags.StringVar(&extractFlags.k8sClusterInfoSecretName, "kubernetes-cluster-info-secret-name", defaultK8sClusterInfoSecretName, "Name of Kubernetes secret that holds the cluster ID")
+	flags.StringVar(&extractFlags.k8sClusterIDSecretKey, "kubernetes-cluster-id-secret-key", defaultK8sClusterIDSecretKey, "Key for the cluster ID secret identified by `kubernetes-cluster-info-secret-name`")
+}
+
+// addWrapFlags adds the flags used to wrap extracted secrets to the given commands.
+func addWrapFlags(cmds ...*cobra.Command) {
+	for _, cmd := range cmds {
+		cmd.Flags().StringVar(&extractFlags.wrapTTL, "wrap-ttl", "", "If set, the secrets are wrapped for single use with this TTL and the target will contain the wrapping token (use `unwrap` to consume it)")
+	}
+}
+
+// assertTargetValid checks that at most one kind of target is selected and that
+// a wrapped secret is written into a file.
+func assertTargetValid() {
+	if extractFlags.k8sSecretName != "" && extractFlags.k8sConfigMapName != "" {
+		Exitf("--kubernetes-secret-name cannot be combined with --kubernetes-configmap-name")
+	}
+	if extractFlags.wrapTTL != "" && extractFlags.k8sSecretName != "" {
+		Exitf("--wrap-ttl cannot be combined with --kubernetes-secret-name")
+	}
+	if extractFlags.wrapTTL != "" && extractFlags.k8sConfigMapName != "" {
+		Exitf("--wrap-ttl cannot be combined with --kubernetes-configmap-name")
+	}
+}
+
+// mustGetKubernetesSecretOptions returns the Kubernetes secret options selected by the --kubernetes-secret-... flags.
+func mustGetKubernetesSecretOptions() service.KubernetesSecretOptions {
+	options := service.KubernetesSecretOptions{
+		Type:        extractFlags.k8sSecretType,
+		Labels:      mustParseKeyValues(extractFlags.k8sSecretLabels, "--kubernetes-secret-label"),
+		Annotations: mustParseKeyValues(extractFlags.k8sSecretAnnotations, "--kubernetes-secret-annotation"),
+		Owner:       extractFlags.k8sSecretOwner,
+	}
+	if err := options.Validate(); err != nil {
+		Exitf(err.Error())
+	}
+	return options
+}
+
+// mustParseKeyValues parses a list of '<key>=<value>' arguments into a map.
+func mustParseKeyValues(args []string, flagName string) map[string]string {
+	result := make(map[string]string)
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			Exitf("Invalid %s '%s', expected <key>=<value>", flagName, arg)
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result
+}
+
 // serverLogin initialized a VaultServices and tries to perform a server login.
 func serverLogin() (*service.AuthenticatedVaultClient, *service.K8sClient, error) {
+	login, k8sclient, err := prepareServerLogin()
+	if err != nil {
+		return nil, nil, maskAny(err)
+	}
+	c, err := login()
+	if err != nil {
+		return nil, nil, maskAny(err)
+	}
+	return c, k8sclient, nil
+}
+
+// prepareServerLogin initialized a VaultServices and returns a function that performs a server login.
+// The returned function can be called multiple times, e.g. to login again once a token has expired.
+func prepareServerLogin() (service.LoginFunc, *service.K8sClient, error) {
 	// Create service
 	vs, err := service.NewVaultService(log, globalFlags.VaultServiceConfig)
 	if err != nil {
 		return nil, nil, maskAny(err)
 	}
 
-	var k8sclient *service.K8sClient
-	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
-	if host != "" && port != "" && (extractFlags.k8sPodName != "" || extractFlags.k8sClusterInfoSecretName != "") {
-		k8sclient, err = service.NewKubernetesClient(extractFlags.k8sPodName, extractFlags.k8sPodIP,
-			extractFlags.k8sClusterInfoSecretName, extractFlags.k8sClusterIDSecretKey)
-		if err != nil {
-			return nil, nil, maskAny(err)
-		}
+	k8sclient, err := newKubernetesClient()
+	if err != nil {
+		return nil, nil, maskAny(err)
 	}
 
-	// Perform server login
+	// Prepare server login data
 	fsData := service.NewFileSystemServerLoginData("", extractFlags.clusterIDPath, extractFlags.machineIDPath, nil)
 	staticData := service.NewStaticServerLoginData(extractFlags.jobID, "", "", fsData)
 	envData := service.NewEnvServerLoginData(staticData)
@@ -92,9 +186,36 @@ func serverLogin() (*service.AuthenticatedVaultClient, *service.K8sClient, error
 		loginData = k8sclient.ServerLoginData(loginData)
 	}
 
-	c, err := vs.ServerLogin(loginData)
+	login := func() (*service.AuthenticatedVaultClient, error) {
+		c, err := vs.ServerLogin(loginData)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		return c, nil
+	}
+	return login, k8sclient, nil
+}
+
+// newKubernetesClient creates a kubernetes client when running in a kubernetes cluster
+// or when a kubeconfig file is given. Otherwise it returns nil.
+func newKubernetesClient() (*service.K8sClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	inCluster := host != "" && port != "" && (extractFlags.k8sNodeName != "" || extractFlags.k8sPodName != "" || extractFlags.k8sClusterInfoSecretName != "")
+	if !inCluster && extractFlags.kubeConfig == "" {
+		return nil, nil
+	}
+	k8sclient, err := service.NewKubernetesClient(log, service.KubernetesClientConfig{
+		KubeConfigPath:        extractFlags.kubeConfig,
+		Context:               extractFlags.k8sContext,
+		Namespace:             extractFlags.k8sNamespace,
+		NodeName:              extractFlags.k8sNodeName,
+		PodName:               extractFlags.k8sPodName,
+		PodIP:                 extractFlags.k8sPodIP,
+		ClusterInfoSecretName: extractFlags.k8sClusterInfoSecretName,
+		ClusterIDSecretKey:    extractFlags.k8sClusterIDSecretKey,
+	})
 	if err != nil {
-		return nil, nil, maskAny(err)
+		return nil, maskAny(err)
 	}
-	return c, k8sclient, nil
+	return k8sclient, nil
 }
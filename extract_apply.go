@@ -0,0 +1,84 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+var (
+	cmdExtractApply = &cobra.Command{
+		Use:     "apply",
+		Short:   "Extract secrets into all targets described in a manifest file.",
+		Example: "-f <manifest-path>",
+		Run:     cmdExtractApplyRun,
+	}
+
+	applyFlags struct {
+		manifestPath string
+	}
+)
+
+func init() {
+	cmdExtractApply.Flags().StringVarP(&applyFlags.manifestPath, "file", "f", "", "Path of the manifest (HCL) file")
+	cmdExtract.AddCommand(cmdExtractApply)
+}
+
+func cmdExtractApplyRun(cmd *cobra.Command, args []string) {
+	// Check arguments
+	assertArgIsSet(applyFlags.manifestPath, "--file")
+	if len(args) != 0 {
+		Exitf("No arguments expected")
+	}
+	assertDryRunFormatValid()
+	hook := mustGetChangeHook()
+
+	// Load manifest
+	m, err := service.LoadManifest(applyFlags.manifestPath)
+	if err != nil {
+		Exitf("Invalid manifest: %v", err)
+	}
+	if fileOptionsFlags.RequireTmpfs {
+		m.RequireTmpfs = true
+	}
+	if fileOptionsFlags.AllowPersistent {
+		m.AllowPersistent = true
+	}
+	if err := m.Validate(); err != nil {
+		Exitf("Invalid manifest: %v", err)
+	}
+
+	// Login
+	c, k8sclient, err := serverLogin()
+	if err != nil {
+		Exitf("Login failed: %#v", err)
+	}
+	if dryRunFlags.enabled {
+		checks, err := c.CheckManifest(m)
+		if err != nil {
+			Exitf("Invalid manifest: %v", err)
+		}
+		exitDryRun(reportAccessChecks(c, checks))
+	}
+
+	// Extract all targets
+	changed, err := c.ApplyManifest(m, k8sclient)
+	if err != nil {
+		Exitf("Secret extraction failed: %v", err)
+	}
+	runChangeHook(hook, changed)
+}
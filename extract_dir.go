@@ -0,0 +1,80 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+var (
+	cmdExtractDir = &cobra.Command{
+		Use:     "dir",
+		Short:   "Extract all secrets under a path into a directory.",
+		Example: "--target=<directory-path> <secret-path>",
+		Run:     cmdExtractDirRun,
+	}
+
+	dirFlags struct {
+		field string
+	}
+)
+
+func init() {
+	addDirFlags(cmdExtractDir)
+	cmdExtract.AddCommand(cmdExtractDir)
+}
+
+func cmdExtractDirRun(cmd *cobra.Command, args []string) {
+	// Check arguments
+	assertArgIsSet(extractFlags.targetFilePath, "--target")
+	secret := mustParseDirSecret(args)
+	fileOptions := mustGetFileOptions()
+	hook := mustGetChangeHook()
+	assertDryRunFormatValid()
+
+	// Login
+	c, _, err := serverLogin()
+	if err != nil {
+		Exitf("Login failed: %#v", err)
+	}
+	if dryRunFlags.enabled {
+		exitDryRun(reportAccessChecks(c, c.CheckSecretDirectory(extractFlags.targetFilePath, secret)))
+	}
+
+	// Create files
+	changed, err := c.CreateSecretDirectory(extractFlags.targetFilePath, secret, fileOptions)
+	if err != nil {
+		Exitf("Secret extraction failed: %v", err)
+	}
+	runChangeHook(hook, changed)
+}
+
+// addDirFlags adds the flags used by all commands that extract secrets into a directory.
+func addDirFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&dirFlags.field, "field", "", "If set, only this field of every secret is written into a file named after the secret (otherwise a file per field is written)")
+}
+
+// mustParseDirSecret parses the arguments of a directory extraction.
+func mustParseDirSecret(args []string) service.DirSecret {
+	if len(args) != 1 {
+		Exitf("Provide exactly one argument: <path>")
+	}
+	return service.DirSecret{
+		SecretPath:  args[0],
+		SecretField: dirFlags.field,
+	}
+}
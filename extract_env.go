@@ -27,24 +27,38 @@ var (
 	cmdExtractEnv = &cobra.Command{
 		Use:     "env",
 		Short:   "Extract a secret into an environment file.",
-		Example: "--target=<file-path> <environment-key>=<secret-path>[#<secret-field>]...",
+		Example: "--target=<file-path> [--format=<format>] <environment-key>=<secret-path>[#<secret-field>]... <key-prefix>*=<secret-path>#*...",
 		Run:     cmdExtractEnvRun,
 	}
+
+	envFlags struct {
+		format        string
+		includeFields []string
+		excludeFields []string
+	}
 )
 
 func init() {
+	addEnvFlags(cmdExtractEnv)
 	cmdExtract.AddCommand(cmdExtractEnv)
 }
 
 func cmdExtractEnvRun(cmd *cobra.Command, args []string) {
 	// Check arguments
-	if extractFlags.k8sSecretName == "" {
+	if extractFlags.k8sSecretName == "" && extractFlags.k8sConfigMapName == "" {
 		assertArgIsSet(extractFlags.targetFilePath, "--target")
 	}
+	assertTargetValid()
+	k8sOptions := mustGetKubernetesSecretOptions()
 	if len(args) == 0 {
-		Exitf("Private at least one argument: <key>=<path>[#field]")
+		Exitf("Provide at least one argument: <key>=<path>[#field]")
 	}
 
+	assertDryRunFormatValid()
+	format := mustGetEnvFormat()
+	fileOptions := mustGetFileOptions()
+	hook := mustGetChangeHook()
+
 	// Parse arguments
 	secrets := []service.EnvSecret{}
 	for _, arg := range args {
@@ -60,33 +74,62 @@ func cmdExtractEnvRun(cmd *cobra.Command, args []string) {
 	if err != nil {
 		Exitf("Login failed: %#v", err)
 	}
+	if dryRunFlags.enabled {
+		exitDryRun(reportAccessChecks(c, c.CheckEnvSecrets(secrets)))
+	}
 
+	var changed bool
 	if extractFlags.k8sSecretName != "" {
 		// Create/update kubernetes secret
-		if err := c.CreateOrUpdateKubernetesSecret(k8sclient, extractFlags.k8sSecretName, secrets...); err != nil {
-			Exitf("Secret extraction failed: %v", err)
-		}
+		changed, err = c.CreateOrUpdateKubernetesSecret(k8sclient, extractFlags.k8sSecretName, k8sOptions, secrets...)
+	} else if extractFlags.k8sConfigMapName != "" {
+		// Create/update kubernetes config map
+		changed, err = c.CreateOrUpdateKubernetesConfigMap(k8sclient, extractFlags.k8sConfigMapName, secrets...)
+	} else if extractFlags.wrapTTL != "" {
+		// Create wrapping token file (a new token every time)
+		changed, err = true, c.CreateWrappedEnvironmentFile(extractFlags.targetFilePath, secrets, extractFlags.wrapTTL, fileOptions)
 	} else {
 		// Create env file
-		if err := c.CreateEnvironmentFile(extractFlags.targetFilePath, secrets); err != nil {
-			Exitf("Secret extraction failed: %v", err)
-		}
+		changed, err = c.CreateEnvironmentFile(extractFlags.targetFilePath, secrets, format, fileOptions)
+	}
+	if err != nil {
+		Exitf("Secret extraction failed: %v", err)
 	}
+	runChangeHook(hook, changed)
 }
 
 func parseEnvSecret(arg string) (service.EnvSecret, error) {
-	kv := strings.Split(arg, "=")
-	if len(kv) != 2 {
-		return service.EnvSecret{}, maskAny(fmt.Errorf("expected '<key>=<path>[#field]', got '%s'", arg))
-	}
-	envKey := kv[0]
-	secretPath, secretField, err := parseSecretPath(kv[1])
+	secret, err := service.ParseEnvSecret(arg)
 	if err != nil {
 		return service.EnvSecret{}, maskAny(err)
 	}
-	return service.EnvSecret{
-		SecretPath:     secretPath,
-		SecretField:    secretField,
-		EnvironmentKey: envKey,
-	}, nil
+	if secret.IsWildcard() {
+		secret.Include = envFlags.includeFields
+		secret.Exclude = envFlags.excludeFields
+	}
+	if err := secret.Validate(); err != nil {
+		return service.EnvSecret{}, maskAny(err)
+	}
+	return secret, nil
+}
+
+// addEnvFlags adds the flags used by all commands that extract secrets into an environment file.
+func addEnvFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&envFlags.format, "format", service.DefaultEnvFormatName, envFormatUsage())
+	cmd.Flags().StringSliceVar(&envFlags.includeFields, "include-field", nil, "If set, only fields matching these patterns are extracted by <key-prefix>*=<path>#*")
+	cmd.Flags().StringSliceVar(&envFlags.excludeFields, "exclude-field", nil, "Fields matching these patterns are not extracted by <key-prefix>*=<path>#*")
+}
+
+// envFormatUsage returns the usage text of the --format flag.
+func envFormatUsage() string {
+	return fmt.Sprintf("Format of the environment file (%s)", strings.Join(service.EnvFormatNames(), "|"))
+}
+
+// mustGetEnvFormat returns the environment file format selected by the --format flag.
+func mustGetEnvFormat() service.EnvFormat {
+	format, err := service.GetEnvFormat(envFlags.format)
+	if err != nil {
+		Exitf("Invalid --format '%s', expected one of %s", envFlags.format, strings.Join(service.EnvFormatNames(), ", "))
+	}
+	return format
 }
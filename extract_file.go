@@ -15,9 +15,6 @@
 package main
 
 import (
-	"fmt"
-	"strings"
-
 	"github.com/spf13/cobra"
 
 	"github.com/pulcy/vault-monkey/service"
@@ -40,9 +37,16 @@ func cmdExtractFileRun(cmd *cobra.Command, args []string) {
 	// Check arguments
 	if extractFlags.k8sSecretName != "" {
 		assertArgIsSet(extractFlags.k8sSecretKey, "--kubernetes-secret-key")
+	} else if extractFlags.k8sConfigMapName != "" {
+		assertArgIsSet(extractFlags.k8sConfigMapKey, "--kubernetes-configmap-key")
 	} else {
 		assertArgIsSet(extractFlags.targetFilePath, "--target")
 	}
+	assertTargetValid()
+	k8sOptions := mustGetKubernetesSecretOptions()
+	assertDryRunFormatValid()
+	fileOptions := mustGetFileOptions()
+	hook := mustGetChangeHook()
 	if len(args) != 1 {
 		Exitf("Provide exactly one argument: <path>[#field]")
 	}
@@ -52,13 +56,26 @@ func cmdExtractFileRun(cmd *cobra.Command, args []string) {
 	if err != nil {
 		Exitf(err.Error())
 	}
+	if secretField == service.WildcardField {
+		Exitf("Extracting all fields (#*) is not supported for a single file, use `extract env` instead")
+	}
 
 	// Login
 	c, k8sclient, err := serverLogin()
 	if err != nil {
 		Exitf("Login failed: %#v", err)
 	}
+	if dryRunFlags.enabled {
+		target := extractFlags.targetFilePath
+		if extractFlags.k8sSecretName != "" {
+			target = extractFlags.k8sSecretName + " (" + extractFlags.k8sSecretKey + ")"
+		} else if extractFlags.k8sConfigMapName != "" {
+			target = extractFlags.k8sConfigMapName + " (" + extractFlags.k8sConfigMapKey + ")"
+		}
+		exitDryRun(reportAccessChecks(c, []service.AccessCheck{c.CheckFileSecret(target, service.FileSecret{SecretPath: secretPath, SecretField: secretField})}))
+	}
 
+	var changed bool
 	if extractFlags.k8sSecretName != "" {
 		// Create/update kubernetes secret
 		secret := service.EnvSecret{
@@ -66,29 +83,38 @@ func cmdExtractFileRun(cmd *cobra.Command, args []string) {
 			SecretField:    secretField,
 			EnvironmentKey: extractFlags.k8sSecretKey,
 		}
-		if err := c.CreateOrUpdateKubernetesSecret(k8sclient, extractFlags.k8sSecretName, secret); err != nil {
-			Exitf("Secret extraction failed: %v", err)
+		changed, err = c.CreateOrUpdateKubernetesSecret(k8sclient, extractFlags.k8sSecretName, k8sOptions, secret)
+	} else if extractFlags.k8sConfigMapName != "" {
+		// Create/update kubernetes config map
+		secret := service.EnvSecret{
+			SecretPath:     secretPath,
+			SecretField:    secretField,
+			EnvironmentKey: extractFlags.k8sConfigMapKey,
 		}
+		changed, err = c.CreateOrUpdateKubernetesConfigMap(k8sclient, extractFlags.k8sConfigMapName, secret)
 	} else {
 		// Create secret file
 		secret := service.FileSecret{
 			SecretPath:  secretPath,
 			SecretField: secretField,
 		}
-		if err := c.CreateSecretFile(extractFlags.targetFilePath, secret); err != nil {
-			Exitf("Secret extraction failed: %v", err)
+		if extractFlags.wrapTTL != "" {
+			// A new wrapping token every time
+			changed, err = true, c.CreateWrappedSecretFile(extractFlags.targetFilePath, secret, extractFlags.wrapTTL, fileOptions)
+		} else {
+			changed, err = c.CreateSecretFile(extractFlags.targetFilePath, secret, fileOptions)
 		}
 	}
+	if err != nil {
+		Exitf("Secret extraction failed: %v", err)
+	}
+	runChangeHook(hook, changed)
 }
 
 func parseSecretPath(arg string) (string, string, error) {
-	pf := strings.Split(arg, "#")
-	switch len(pf) {
-	case 1:
-		return arg, "value", nil
-	case 2:
-		return pf[0], pf[1], nil
-	default:
-		return "", "", maskAny(fmt.Errorf("expected '<path>[#field]', got '%s'", arg))
+	secretPath, secretField, err := service.ParseSecretPath(arg)
+	if err != nil {
+		return "", "", maskAny(err)
 	}
+	return secretPath, secretField, nil
 }
@@ -0,0 +1,65 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdExtractTemplate = &cobra.Command{
+		Use:     "template",
+		Short:   "Render a template containing secrets into a file.",
+		Example: "--source=<template-path> --target=<file-path>",
+		Run:     cmdExtractTemplateRun,
+	}
+
+	templateFlags struct {
+		sourcePath string
+	}
+)
+
+func init() {
+	cmdExtractTemplate.Flags().StringVar(&templateFlags.sourcePath, "source", "", "Path of the Go text template to render")
+	cmdExtract.AddCommand(cmdExtractTemplate)
+}
+
+func cmdExtractTemplateRun(cmd *cobra.Command, args []string) {
+	// Check arguments
+	assertArgIsSet(templateFlags.sourcePath, "--source")
+	assertArgIsSet(extractFlags.targetFilePath, "--target")
+	if len(args) != 0 {
+		Exitf("No arguments expected")
+	}
+	assertDryRunFormatValid()
+	fileOptions := mustGetFileOptions()
+	hook := mustGetChangeHook()
+
+	// Login
+	c, _, err := serverLogin()
+	if err != nil {
+		Exitf("Login failed: %#v", err)
+	}
+	if dryRunFlags.enabled {
+		exitDryRun(reportAccessChecks(c, c.CheckTemplateFile(extractFlags.targetFilePath, templateFlags.sourcePath)))
+	}
+
+	// Create file
+	changed, err := c.CreateTemplateFile(extractFlags.targetFilePath, templateFlags.sourcePath, fileOptions)
+	if err != nil {
+		Exitf("Secret extraction failed: %v", err)
+	}
+	runChangeHook(hook, changed)
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+const (
+	defaultWatchInterval = time.Minute * 5
+)
+
+var (
+	cmdExtractWatch = &cobra.Command{
+		Use:   "watch",
+		Short: "Keep extracted secrets up to date (runs until stopped)",
+		Run:   showUsage,
+	}
+
+	cmdExtractWatchEnv = &cobra.Command{
+		Use:     "env",
+		Short:   "Keep an environment file with secrets up to date.",
+		Example: "--target=<file-path> [--format=<format>] <environment-key>=<secret-path>[#<secret-field>]...",
+		Run:     cmdExtractWatchEnvRun,
+	}
+
+	cmdExtractWatchFile = &cobra.Command{
+		Use:     "file",
+		Short:   "Keep a file with a secret up to date.",
+		Example: "--target=<file-path> <secret-path>[#<secret-field>]",
+		Run:     cmdExtractWatchFileRun,
+	}
+
+	cmdExtractWatchTemplate = &cobra.Command{
+		Use:     "template",
+		Short:   "Keep a file rendered from a template containing secrets up to date.",
+		Example: "--source=<template-path> --target=<file-path>",
+		Run:     cmdExtractWatchTemplateRun,
+	}
+
+	cmdExtractWatchDir = &cobra.Command{
+		Use:     "dir",
+		Short:   "Keep a directory with all secrets under a path up to date.",
+		Example: "--target=<directory-path> <secret-path>",
+		Run:     cmdExtractWatchDirRun,
+	}
+
+	watchFlags struct {
+		interval      time.Duration
+		revokeLeases  bool
+		cleanupOnExit bool
+	}
+)
+
+func init() {
+	cmdExtractWatch.PersistentFlags().DurationVar(&watchFlags.interval, "interval", defaultWatchInterval, "Time between 2 checks for changed secrets")
+	cmdExtractWatch.PersistentFlags().BoolVar(&watchFlags.revokeLeases, "revoke-leases", true, "If set, the leases of dynamic secrets are revoked when stopped")
+	cmdExtractWatch.PersistentFlags().BoolVar(&watchFlags.cleanupOnExit, "cleanup-on-exit", false, "If set, all targets written by this process are securely removed when stopped (see `cleanup`)")
+	addEnvFlags(cmdExtractWatchEnv)
+	cmdExtractWatch.AddCommand(cmdExtractWatchEnv)
+	cmdExtractWatch.AddCommand(cmdExtractWatchFile)
+	cmdExtractWatchTemplate.Flags().StringVar(&templateFlags.sourcePath, "source", "", "Path of the Go text template to render")
+	cmdExtractWatch.AddCommand(cmdExtractWatchTemplate)
+	addDirFlags(cmdExtractWatchDir)
+	cmdExtractWatch.AddCommand(cmdExtractWatchDir)
+	cmdExtract.AddCommand(cmdExtractWatch)
+}
+
+func cmdExtractWatchEnvRun(cmd *cobra.Command, args []string) {
+	// Check arguments
+	assertArgIsSet(extractFlags.targetFilePath, "--target")
+	if len(args) == 0 {
+		Exitf("Provide at least one argument: <key>=<path>[#field]")
+	}
+	format := mustGetEnvFormat()
+
+	// Parse arguments
+	secrets := []service.EnvSecret{}
+	for _, arg := range args {
+		secret, err := parseEnvSecret(arg)
+		if err != nil {
+			Exitf(err.Error())
+		}
+		secrets = append(secrets, secret)
+	}
+
+	runWatch(service.NewEnvironmentFileTarget(extractFlags.targetFilePath, secrets, format, mustGetFileOptions()))
+}
+
+func cmdExtractWatchFileRun(cmd *cobra.Command, args []string) {
+	// Check arguments
+	assertArgIsSet(extractFlags.targetFilePath, "--target")
+	if len(args) != 1 {
+		Exitf("Provide exactly one argument: <path>[#field]")
+	}
+
+	// Parse arguments
+	secretPath, secretField, err := parseSecretPath(args[0])
+	if err != nil {
+		Exitf(err.Error())
+	}
+	if secretField == service.WildcardField {
+		Exitf("Extracting all fields (#*) is not supported for a single file, use `extract watch env` instead")
+	}
+	secret := service.FileSecret{
+		SecretPath:  secretPath,
+		SecretField: secretField,
+	}
+
+	runWatch(service.NewSecretFileTarget(extractFlags.targetFilePath, secret, mustGetFileOptions()))
+}
+
+func cmdExtractWatchTemplateRun(cmd *cobra.Command, args []string) {
+	// Check arguments
+	assertArgIsSet(templateFlags.sourcePath, "--source")
+	assertArgIsSet(extractFlags.targetFilePath, "--target")
+	if len(args) != 0 {
+		Exitf("No arguments expected")
+	}
+
+	runWatch(service.NewTemplateFileTarget(extractFlags.targetFilePath, templateFlags.sourcePath, mustGetFileOptions()))
+}
+
+func cmdExtractWatchDirRun(cmd *cobra.Command, args []string) {
+	// Check arguments
+	assertArgIsSet(extractFlags.targetFilePath, "--target")
+	secret := mustParseDirSecret(args)
+
+	runWatch(service.NewSecretDirectoryTarget(extractFlags.targetFilePath, secret, mustGetFileOptions()))
+}
+
+// runWatch keeps the given targets up to date until the process receives a termination signal.
+func runWatch(targets ...service.WatchTarget) {
+	if watchFlags.interval <= 0 {
+		Exitf("--interval must be positive")
+	}
+	if hook := mustGetChangeHook(); hook.IsSet() {
+		for i, t := range targets {
+			targets[i] = service.NewHookTarget(log, t, hook)
+		}
+	}
+	login, k8sclient, err := prepareServerLogin()
+	if err != nil {
+		Exitf("Login preparation failed: %#v", err)
+	}
+
+	config := service.WatchConfig{
+		Interval:           watchFlags.interval,
+		RevokeLeasesOnStop: watchFlags.revokeLeases,
+	}
+	service.Watch(log, login, config, newStopChannel(), targets...)
+	if watchFlags.cleanupOnExit {
+		if err := service.CleanupWrittenTargets(log, k8sclient); err != nil {
+			Exitf("Cleanup failed: %v", err)
+		}
+	}
+}
+
+// newStopChannel returns a channel that is closed when the process receives a termination signal.
+func newStopChannel() <-chan struct{} {
+	stop := make(chan struct{})
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Infof("Received %s, stopping", sig)
+		close(stop)
+	}()
+	return stop
+}
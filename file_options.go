@@ -0,0 +1,42 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/pflag"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+var (
+	fileOptionsFlags service.FileOptions
+)
+
+// addFileOptionsFlags adds the flags that specify the mode, ownership & storage of the target file to the given flag set.
+func addFileOptionsFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&fileOptionsFlags.Mode, "mode", "", "Octal mode of the target file (defaults to 0400)")
+	flags.StringVar(&fileOptionsFlags.Owner, "owner", "", "Name or uid of the owner of the target file")
+	flags.StringVar(&fileOptionsFlags.Group, "group", "", "Name or gid of the group of the target file")
+	flags.BoolVar(&fileOptionsFlags.AllowPersistent, "allow-persistent", false, "If set, the target file may be written to a filesystem other than tmpfs or ramfs")
+	flags.BoolVar(&fileOptionsFlags.RequireTmpfs, "require-tmpfs", false, "If set, the target file must be written to tmpfs or ramfs, even when allowed otherwise")
+}
+
+// mustGetFileOptions returns the options specified by the --mode, --owner, --group, --allow-persistent & --require-tmpfs flags.
+func mustGetFileOptions() service.FileOptions {
+	if err := fileOptionsFlags.Validate(); err != nil {
+		Exitf("Invalid file options: %v", err)
+	}
+	return fileOptionsFlags
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/pflag"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+var (
+	hookFlags struct {
+		onChange string
+		signal   string
+		pidFile  string
+	}
+)
+
+// addChangeHookFlags adds the flags that specify what to do after a target has changed to the given flag set.
+func addChangeHookFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&hookFlags.onChange, "on-change", "", "Command to run (using /bin/sh -c) when the target has changed (e.g. 'systemctl reload nginx')")
+	flags.StringVar(&hookFlags.signal, "signal", "", "Signal to send (e.g. SIGHUP) to the process in --pidfile when the target has changed")
+	flags.StringVar(&hookFlags.pidFile, "pidfile", "", "Path of a file containing the ID of the process to send --signal to")
+}
+
+// mustGetChangeHook returns the hook specified by the --on-change, --signal & --pidfile flags.
+func mustGetChangeHook() service.ChangeHook {
+	hook := service.ChangeHook{
+		Command: hookFlags.onChange,
+		PIDFile: hookFlags.pidFile,
+	}
+	if hookFlags.signal != "" {
+		assertArgIsSet(hookFlags.pidFile, "--pidfile")
+		sig, err := service.ParseSignal(hookFlags.signal)
+		if err != nil {
+			Exitf("Invalid --signal: %v", err)
+		}
+		hook.Signal = sig
+	} else if hookFlags.pidFile != "" {
+		Exitf("--pidfile requires --signal")
+	}
+	return hook
+}
+
+// runChangeHook runs the given hook if the target has changed.
+func runChangeHook(hook service.ChangeHook, changed bool) {
+	if !changed || !hook.IsSet() {
+		return
+	}
+	if err := hook.Run(log); err != nil {
+		Exitf("Change hook failed: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+var (
+	cmdK8sController = &cobra.Command{
+		Use:     "controller",
+		Short:   "Fill & refresh all Kubernetes secrets annotated with " + service.KubernetesPathsAnnotation + " (runs until stopped)",
+		Example: "--allowed-path-prefix=<path> [--interval=<duration>]",
+		Run:     cmdK8sControllerRun,
+	}
+
+	k8sControllerFlags struct {
+		interval            time.Duration
+		allowedPathPrefixes []string
+	}
+)
+
+func init() {
+	cmdK8sController.Flags().StringSliceVar(&k8sControllerFlags.allowedPathPrefixes, "allowed-path-prefix", nil, "Vault path prefix below which annotated secrets may be synced (required, can be repeated)")
+	cmdK8sController.Flags().DurationVar(&k8sControllerFlags.interval, "interval", defaultWatchInterval, "Time between 2 syncs of all annotated secrets")
+	addServerLoginFlags(cmdK8sController.Flags())
+	cmdK8s.AddCommand(cmdK8sController)
+}
+
+func cmdK8sControllerRun(cmd *cobra.Command, args []string) {
+	if k8sControllerFlags.interval <= 0 {
+		Exitf("--interval must be positive")
+	}
+	if len(k8sControllerFlags.allowedPathPrefixes) == 0 {
+		Exitf("--allowed-path-prefix must be set")
+	}
+	login, k8sclient, err := prepareServerLogin()
+	if err != nil {
+		Exitf("Login preparation failed: %#v", err)
+	}
+	if k8sclient == nil {
+		Exitf("The controller must run inside Kubernetes or use --kubeconfig")
+	}
+
+	config := service.WatchConfig{
+		Interval: k8sControllerFlags.interval,
+		// Synced secrets remain in use after the controller stops, so leases are kept.
+		RevokeLeasesOnStop: false,
+	}
+	target, err := service.NewKubernetesSecretSyncTarget(k8sclient, k8sControllerFlags.allowedPathPrefixes)
+	if err != nil {
+		Exitf("Invalid --allowed-path-prefix: %v", err)
+	}
+	service.Watch(log, login, config, newStopChannel(), target)
+}
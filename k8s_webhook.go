@@ -0,0 +1,91 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+const (
+	defaultWebhookListenAddress = ":8443"
+	defaultWebhookPath          = "/mutate"
+)
+
+var (
+	cmdK8sWebhook = &cobra.Command{
+		Use:     "webhook",
+		Short:   "Run an admission webhook that injects vault-monkey into pods annotated with " + service.KubernetesInjectAnnotation + " (runs until stopped)",
+		Example: "--image=<image> --tls-cert-file=<path> --tls-key-file=<path> [--listen-address=<address>]",
+		Run:     cmdK8sWebhookRun,
+	}
+
+	k8sWebhookFlags struct {
+		listenAddress   string
+		tlsCertFile     string
+		tlsKeyFile      string
+		image           string
+		imagePullPolicy string
+		reviewFile      string
+	}
+)
+
+func init() {
+	cmdK8sWebhook.Flags().StringVar(&k8sWebhookFlags.listenAddress, "listen-address", defaultWebhookListenAddress, "Address the HTTPS server listens on")
+	cmdK8sWebhook.Flags().StringVar(&k8sWebhookFlags.tlsCertFile, "tls-cert-file", "", "Path of the TLS certificate of the HTTPS server")
+	cmdK8sWebhook.Flags().StringVar(&k8sWebhookFlags.tlsKeyFile, "tls-key-file", "", "Path of the TLS private key of the HTTPS server")
+	cmdK8sWebhook.Flags().StringVar(&k8sWebhookFlags.image, "image", "", "Image (containing vault-monkey) of the injected init container")
+	cmdK8sWebhook.Flags().StringVar(&k8sWebhookFlags.imagePullPolicy, "image-pull-policy", "", "Pull policy of the injected init container (defaults to IfNotPresent)")
+	cmdK8sWebhook.Flags().StringVar(&k8sWebhookFlags.reviewFile, "review", "", "Path of an AdmissionReview file to answer on stdout, instead of running the server")
+	cmdK8s.AddCommand(cmdK8sWebhook)
+}
+
+func cmdK8sWebhookRun(cmd *cobra.Command, args []string) {
+	assertArgIsSet(k8sWebhookFlags.image, "--image")
+	config := service.WebhookConfig{
+		Image:               k8sWebhookFlags.image,
+		ImagePullPolicy:     k8sWebhookFlags.imagePullPolicy,
+		VaultAddr:           globalFlags.VaultAddr,
+		KubernetesAuthMount: globalFlags.KubernetesAuthMount,
+		AuthMethods:         globalFlags.AuthMethods,
+	}
+
+	if k8sWebhookFlags.reviewFile != "" {
+		review, err := ioutil.ReadFile(k8sWebhookFlags.reviewFile)
+		if err != nil {
+			Exitf("Cannot read admission review: %v", err)
+		}
+		response, err := config.ReviewPod(log, review)
+		if err != nil {
+			Exitf("Cannot answer admission review: %v", err)
+		}
+		fmt.Println(string(response))
+		return
+	}
+
+	assertArgIsSet(k8sWebhookFlags.tlsCertFile, "--tls-cert-file")
+	assertArgIsSet(k8sWebhookFlags.tlsKeyFile, "--tls-key-file")
+	mux := http.NewServeMux()
+	mux.Handle(defaultWebhookPath, service.NewWebhookHandler(log, config))
+	log.Infof("Listening for admission reviews on %s%s", k8sWebhookFlags.listenAddress, defaultWebhookPath)
+	if err := http.ListenAndServeTLS(k8sWebhookFlags.listenAddress, k8sWebhookFlags.tlsCertFile, k8sWebhookFlags.tlsKeyFile, mux); err != nil {
+		Exitf("Webhook server failed: %v", err)
+	}
+}
@@ -40,18 +40,29 @@ const (
 
 type globalOptions struct {
 	logLevel string
+	stateDir string
 	service.VaultServiceConfig
 	ghToken string
 }
 
 var (
 	cmdMain = &cobra.Command{
-		Use:              projectName,
-		Run:              showUsage,
-		PersistentPreRun: func(*cobra.Command, []string) { setLogLevel(globalFlags.logLevel) },
+		Use: projectName,
+		Run: showUsage,
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			setLogLevel(globalFlags.logLevel)
+			enableStateFile(cmd.Flags().Changed("state-dir"))
+			if len(globalFlags.AuthMethods) > 0 {
+				if err := service.ValidateAuthMethods(globalFlags.VaultServiceConfig); err != nil {
+					Exitf("Invalid --auth-methods: %v", err)
+				}
+			}
+		},
 	}
 	globalFlags globalOptions
-	log         = logging.MustGetLogger(cmdMain.Use)
+	// stateFileErr is set when written targets cannot be recorded in a state file
+	stateFileErr error
+	log          = logging.MustGetLogger(projectName)
 )
 
 func init() {
@@ -62,6 +73,7 @@ func init() {
 	globalFlags.IPv4Only = boolFromEnv("VAULT_IPV4_ONLY", false)
 	globalFlags.IPv6Only = boolFromEnv("VAULT_IPV6_ONLY", false)
 	cmdMain.PersistentFlags().StringVar(&globalFlags.logLevel, "log-level", defaultLogLevel, "Log level (debug|info|warning|error)")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.stateDir, "state-dir", service.DefaultStateDir, "Directory of the state file in which all written targets are recorded for cleanup (empty to disable recording)")
 	cmdMain.PersistentFlags().StringVar(&globalFlags.VaultAddr, "vault-addr", globalFlags.VaultAddr, "URL of the vault (defaults to VAULT_ADDR environment variable)")
 	cmdMain.PersistentFlags().StringVar(&globalFlags.VaultCACert, "vault-cacert", globalFlags.VaultCACert, "Path to a PEM-encoded CA cert file to use to verify the Vault server SSL certificate")
 	cmdMain.PersistentFlags().StringVar(&globalFlags.VaultCAPath, "vault-capath", globalFlags.VaultCAPath, "Path to a directory of PEM-encoded CA cert files to verify the Vault server SSL certificate")
@@ -71,6 +83,28 @@ func init() {
 	cmdMain.PersistentFlags().BoolVar(&globalFlags.IPv6Only, "vault-ipv6-only", globalFlags.IPv6Only, "If set, only use IPv6 addresses")
 	cmdMain.PersistentFlags().BoolVar(&globalFlags.DisableAppID, "vault-disable-app-id", globalFlags.DisableAppID, "If set, do not use app-id authentication")
 	cmdMain.PersistentFlags().BoolVar(&globalFlags.DisableAppRole, "vault-disable-approle", globalFlags.DisableAppRole, "If set, do not use approle authentication")
+	cmdMain.PersistentFlags().StringSliceVar(&globalFlags.AuthMethods, "auth-methods", nil, "Comma separated list of authentication methods used for server logins, in the order in which they are attempted ("+strings.Join(service.LoginMethodNames(), ", ")+")")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.KubernetesAuthMount, "vault-kubernetes-auth-mount", "", "If set, use the kubernetes (or JWT) auth method mounted at this path for the first step of a server login")
+	cmdMain.PersistentFlags().StringVar(&globalFlags.KubernetesJWTPath, "vault-kubernetes-jwt-path", service.DefaultKubernetesJWTPath, "Path of the service account token used for kubernetes authentication")
+}
+
+// enableStateFile enables recording all written targets in a state file in the --state-dir directory.
+// Recording is best effort: when the directory cannot be used, targets are not recorded in a state file.
+// That is only reported as a warning when --state-dir is set explicitly.
+func enableStateFile(explicit bool) {
+	dir := globalFlags.stateDir
+	if dir == "" {
+		stateFileErr = fmt.Errorf("--state-dir not set")
+		return
+	}
+	if err := service.EnableStateFile(log, dir); err != nil {
+		stateFileErr = err
+		if explicit {
+			log.Warningf("Written targets are not recorded: %s", err)
+		} else {
+			log.Debugf("Written targets are not recorded: %s", err)
+		}
+	}
 }
 
 func main() {
@@ -30,6 +30,11 @@ var (
 		Short: "Migrate vault data between backends.",
 		Run:   cmdMigrateRun,
 	}
+	cmdMigratePolicies = &cobra.Command{
+		Use:   "policies",
+		Short: "Rewrite the policies of all clusters to match the KV version of the cluster-auth data.",
+		Run:   cmdMigratePoliciesRun,
+	}
 )
 
 func init() {
@@ -38,6 +43,7 @@ func init() {
 	cmdMigrate.Flags().StringVar(&toType, "to-type", "", "Type of destination backend")
 	cmdMigrate.Flags().StringVar(&toAddress, "to-address", "", "Address of destination backend")
 
+	cmdMigrate.AddCommand(cmdMigratePolicies)
 	cmdMain.AddCommand(cmdMigrate)
 }
 
@@ -49,6 +55,21 @@ func cmdMigrateRun(cmd *cobra.Command, args []string) {
 	}
 }
 
+func cmdMigratePoliciesRun(cmd *cobra.Command, args []string) {
+	_, c, err := adminLogin()
+	if err != nil {
+		Exitf("Login failed: %v", err)
+	}
+
+	clusterIDs, err := c.Cluster().MigratePolicies()
+	if err != nil {
+		Exitf("Failed to migrate cluster policies: %v", err)
+	}
+	for _, id := range clusterIDs {
+		log.Infof("Migrated policy of cluster %s", id)
+	}
+}
+
 func mustCreateBackend(bType, bAddress string) migration.Backend {
 	var b migration.Backend
 	var err error
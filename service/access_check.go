@@ -0,0 +1,212 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"path"
+	"strings"
+)
+
+// AccessStatus is the outcome of checking access to a single secret (field).
+type AccessStatus string
+
+const (
+	AccessOK           AccessStatus = "ok"            // The secret (field) can be extracted
+	AccessDenied       AccessStatus = "denied"        // The token has no read capability on the path
+	AccessMissingPath  AccessStatus = "missing-path"  // There is no secret at the path
+	AccessMissingField AccessStatus = "missing-field" // The secret has no such field (or no field selected by a wildcard)
+	AccessError        AccessStatus = "error"         // Any other failure
+)
+
+// AccessCheck holds the result of checking access to a single secret (field) that would be extracted.
+type AccessCheck struct {
+	Target       string       `json:"target,omitempty"` // File, Kubernetes secret or environment key the secret would be extracted into
+	Path         string       `json:"path"`
+	Field        string       `json:"field,omitempty"`
+	Capabilities []string     `json:"capabilities"`
+	Status       AccessStatus `json:"status"`
+	Message      string       `json:"message,omitempty"`
+}
+
+// OK returns true if the secret (field) can be extracted.
+func (a AccessCheck) OK() bool {
+	return a.Status == AccessOK
+}
+
+// CheckEnvSecrets checks that all given secrets can be extracted, without writing anything.
+// The target of every check is its environment key.
+func (c *AuthenticatedVaultClient) CheckEnvSecrets(secrets []EnvSecret) []AccessCheck {
+	result := []AccessCheck{}
+	for _, s := range secrets {
+		result = append(result, c.checkEnvSecret(s.EnvironmentKey, s))
+	}
+	return result
+}
+
+// CheckFileSecret checks that the given secret can be extracted into the given target, without writing anything.
+func (c *AuthenticatedVaultClient) CheckFileSecret(target string, secret FileSecret) AccessCheck {
+	return c.checkEnvSecret(target, EnvSecret{SecretPath: secret.SecretPath, SecretField: secret.SecretField})
+}
+
+// CheckSecretDirectory checks that all secrets in the subtree of the given secret can be extracted
+// into the given directory, without writing anything.
+// The target of every check is the file (or directory, when extracting all fields) that would be written.
+func (c *AuthenticatedVaultClient) CheckSecretDirectory(dir string, secret DirSecret) []AccessCheck {
+	result := AccessCheck{
+		Target:       dir,
+		Path:         secret.SecretPath,
+		Field:        secret.SecretField,
+		Capabilities: []string{},
+	}
+	root := strings.Trim(secret.SecretPath, "/")
+	if root == "" {
+		result.Status = AccessError
+		result.Message = "path not set"
+		return []AccessCheck{result}
+	}
+	if _, version := splitSecretVersion(root); version != 0 {
+		result.Status = AccessError
+		result.Message = "versions are only supported for single secrets"
+		return []AccessCheck{result}
+	}
+	secretPaths, err := c.listSecrets(root)
+	if err != nil {
+		result.Status = AccessError
+		result.Message = err.Error()
+		return []AccessCheck{result}
+	}
+	if len(secretPaths) == 0 {
+		result.Status = AccessMissingPath
+		result.Message = "no secrets found under " + secret.SecretPath
+		return []AccessCheck{result}
+	}
+	checks := []AccessCheck{}
+	for _, secretPath := range secretPaths {
+		target := path.Join(dir, strings.TrimPrefix(secretPath, root+"/"))
+		s := EnvSecret{SecretPath: secretPath, SecretField: secret.SecretField}
+		if s.SecretField == "" {
+			s.SecretField = WildcardField
+			s.EnvironmentKey = wildcardKey
+		}
+		checks = append(checks, c.checkEnvSecret(target, s))
+	}
+	return checks
+}
+
+// CheckManifest checks that all secrets of all targets of the given manifest can be extracted, without writing anything.
+func (c *AuthenticatedVaultClient) CheckManifest(m *Manifest) ([]AccessCheck, error) {
+	if err := m.Validate(); err != nil {
+		return nil, maskAny(err)
+	}
+	result := []AccessCheck{}
+	for _, t := range m.EnvFiles {
+		secrets, _ := t.envSecrets()
+		for _, s := range secrets {
+			result = append(result, c.checkEnvSecret(t.Path+" ("+s.EnvironmentKey+")", s))
+		}
+	}
+	for _, t := range m.Files {
+		secret, _ := t.fileSecret()
+		result = append(result, c.CheckFileSecret(t.Path, secret))
+	}
+	for _, t := range m.Templates {
+		result = append(result, c.CheckTemplateFile(t.Path, t.Source)...)
+	}
+	for _, t := range m.KubernetesSecrets {
+		secrets, _ := t.envSecrets()
+		for _, s := range secrets {
+			result = append(result, c.checkEnvSecret(t.Name+" ("+s.EnvironmentKey+")", s))
+		}
+	}
+	return result, nil
+}
+
+// checkEnvSecret checks the read capability of the token on the path of the given secret
+// and then reads the secret to check that the requested field(s) exist.
+func (c *AuthenticatedVaultClient) checkEnvSecret(target string, secret EnvSecret) AccessCheck {
+	result := AccessCheck{
+		Target:       target,
+		Path:         secret.SecretPath,
+		Field:        secret.SecretField,
+		Capabilities: []string{},
+	}
+	fail := func(status AccessStatus, err error) AccessCheck {
+		result.Status = status
+		result.Message = err.Error()
+		return result
+	}
+	if err := secret.Validate(); err != nil {
+		return fail(AccessError, err)
+	}
+
+	// Check capabilities
+	path, _ := splitSecretVersion(secret.SecretPath)
+	policyPath, err := c.kv.policyPath(path)
+	if err != nil {
+		return fail(AccessError, err)
+	}
+	capabilities, err := c.vaultClient.Sys().CapabilitiesSelf(strings.TrimPrefix(policyPath, "/"))
+	if err != nil {
+		return fail(AccessError, err)
+	}
+	if capabilities != nil {
+		result.Capabilities = capabilities
+	}
+	if !hasReadCapability(capabilities) {
+		result.Status = AccessDenied
+		result.Message = "no read capability on " + policyPath
+		return result
+	}
+
+	// Read secret & field(s)
+	if _, err := c.readSecret(secret.SecretPath); IsSecretNotFound(err) {
+		return fail(AccessMissingPath, err)
+	} else if err != nil {
+		return fail(AccessError, err)
+	}
+	if secret.IsWildcard() {
+		fields, err := c.extractSecretFields(secret.SecretPath)
+		if err != nil {
+			return fail(AccessError, err)
+		}
+		selected := 0
+		for name := range fields {
+			if secret.includesField(name) {
+				selected++
+			}
+		}
+		if selected == 0 {
+			result.Status = AccessMissingField
+			result.Message = "no fields selected at " + secret.SecretPath
+			return result
+		}
+	} else if _, err := c.extractSecret(secret.SecretPath, secret.SecretField); IsSecretNotFound(err) {
+		return fail(AccessMissingField, err)
+	} else if err != nil {
+		return fail(AccessError, err)
+	}
+	result.Status = AccessOK
+	return result
+}
+
+// hasReadCapability returns true if the given capabilities allow reading.
+func hasReadCapability(capabilities []string) bool {
+	for _, c := range capabilities {
+		if c == "read" || c == "root" {
+			return true
+		}
+	}
+	return false
+}
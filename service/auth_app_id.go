@@ -0,0 +1,103 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func init() {
+	RegisterLoginMethod(LoginMethodAppID, func(VaultServiceConfig) (LoginMethod, error) {
+		return appIDMethod{}, nil
+	})
+}
+
+// appIDMethod implements the app-id authentication method.
+// Roles are mapped as app-id's and secrets as user-id's.
+type appIDMethod struct{}
+
+// Name returns the name used to select the method.
+func (appIDMethod) Name() string {
+	return LoginMethodAppID
+}
+
+// RequiresSecret returns true, since app-id logins need a user-id.
+func (appIDMethod) RequiresSecret() bool {
+	return true
+}
+
+// Login attempts an app-id login using given app-id & user-id.
+func (appIDMethod) Login(vaultClient *api.Client, role string, secret interface{}) error {
+	vaultClient.ClearToken()
+	data := make(map[string]interface{})
+	data["app_id"] = role
+	data["user_id"] = secret
+	loginSecret, err := vaultClient.Logical().Write("auth/app-id/login", data)
+	if err != nil {
+		return maskAny(err)
+	}
+	if err := loginResponse(vaultClient, loginSecret); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// CreateRole creates the app-id mapping for the given role to the given policy.
+func (appIDMethod) CreateRole(vaultClient *api.Client, role, policyName string) error {
+	path := fmt.Sprintf("auth/app-id/map/app-id/%s", role)
+	data := make(map[string]interface{})
+	data["value"] = policyName
+	data["display_name"] = role
+	if _, err := vaultClient.Logical().Write(path, data); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// DeleteRole removes the app-id mapping for the given role.
+func (appIDMethod) DeleteRole(vaultClient *api.Client, role string) error {
+	path := fmt.Sprintf("auth/app-id/map/app-id/%s", role)
+	if _, err := vaultClient.Logical().Delete(path); err != nil {
+		return maskAny(err)
+	}
+	// TODO remove all user-id mappings for this app-id (don't see a way how yet)
+	// TODO remove all tokens created for this app-id (don't see a way how yet)
+	return nil
+}
+
+// AddSecret creates the user-id mapping of the given secret to the given role.
+func (appIDMethod) AddSecret(vaultClient *api.Client, role string, secret interface{}, cidrBlock string) error {
+	path := fmt.Sprintf("auth/app-id/map/user-id/%v", secret)
+	data := make(map[string]interface{})
+	data["value"] = role
+	if cidrBlock != "" {
+		data["cidr_block"] = cidrBlock
+	}
+	if _, err := vaultClient.Logical().Write(path, data); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// RemoveSecret removes the user-id mapping of the given secret.
+func (appIDMethod) RemoveSecret(vaultClient *api.Client, role string, secret interface{}) error {
+	path := fmt.Sprintf("auth/app-id/map/user-id/%v", secret)
+	if _, err := vaultClient.Logical().Delete(path); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
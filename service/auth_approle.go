@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+)
+
+func init() {
+	RegisterLoginMethod(LoginMethodAppRole, func(VaultServiceConfig) (LoginMethod, error) {
+		return appRoleMethod{}, nil
+	})
+}
+
+// appRoleMethod implements the approle authentication method.
+// Roles use their name as role-id and secrets are added as custom secret-id's.
+type appRoleMethod struct{}
+
+// Name returns the name used to select the method.
+func (appRoleMethod) Name() string {
+	return LoginMethodAppRole
+}
+
+// RequiresSecret returns true, since approle logins need a secret-id.
+func (appRoleMethod) RequiresSecret() bool {
+	return true
+}
+
+// Login attempts an approle login using given role-id & secret-id.
+func (appRoleMethod) Login(vaultClient *api.Client, role string, secret interface{}) error {
+	vaultClient.ClearToken()
+	data := make(map[string]interface{})
+	data["role_id"] = role
+	data["secret_id"] = secret
+	loginSecret, err := vaultClient.Logical().Write("auth/approle/login", data)
+	if err != nil {
+		return maskAny(err)
+	}
+	if err := loginResponse(vaultClient, loginSecret); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// CreateRole creates a role with given name (also used as role-id) that is granted the given policy.
+func (appRoleMethod) CreateRole(vaultClient *api.Client, role, policyName string) error {
+	// Create role
+	{
+		path := fmt.Sprintf("auth/approle/role/%s", role)
+		data := make(map[string]interface{})
+		data["role_name"] = role
+		data["bind_secret_id"] = true
+		data["policies"] = policyName
+		data["secret_id_num_uses"] = 0
+		if _, err := vaultClient.Logical().Write(path, data); err != nil {
+			return maskAny(err)
+		}
+	}
+	// Set role_id
+	{
+		path := fmt.Sprintf("auth/approle/role/%s/role-id", role)
+		data := make(map[string]interface{})
+		data["role_id"] = role
+		if _, err := vaultClient.Logical().Write(path, data); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// DeleteRole removes the role with given name.
+func (appRoleMethod) DeleteRole(vaultClient *api.Client, role string) error {
+	path := fmt.Sprintf("auth/approle/role/%s", role)
+	if _, err := vaultClient.Logical().Delete(path); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// AddSecret adds the given secret as custom secret-id of the given role.
+func (appRoleMethod) AddSecret(vaultClient *api.Client, role string, secret interface{}, cidrBlock string) error {
+	path := fmt.Sprintf("auth/approle/role/%s/custom-secret-id", role)
+	data := make(map[string]interface{})
+	data["secret_id"] = secret
+	if cidrBlock != "" {
+		data["cidr_list"] = cidrBlock
+	}
+	if _, err := vaultClient.Logical().Write(path, data); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// RemoveSecret destroys the given secret-id of the given role.
+func (appRoleMethod) RemoveSecret(vaultClient *api.Client, role string, secret interface{}) error {
+	path := fmt.Sprintf("/auth/approle/role/%s/secret-id/destroy", role)
+	data := make(map[string]interface{})
+	data["secret_id"] = secret
+	if _, err := vaultClient.Logical().Write(path, data); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
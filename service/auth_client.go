@@ -15,7 +15,12 @@
 package service
 
 import (
+	"encoding/json"
+	"fmt"
+	"time"
+
 	"github.com/hashicorp/vault/api"
+	"github.com/juju/errgo"
 	"github.com/op/go-logging"
 )
 
@@ -23,7 +28,9 @@ import (
 type AuthenticatedVaultClient struct {
 	log         *logging.Logger
 	vaultClient *api.Client
-	authMethods AuthMethod
+	authMethods []LoginMethod
+	leases      *leaseCache
+	kv          *kvClient
 }
 
 // Cluster returns a helper to configure cluster authentication secrets.
@@ -45,3 +52,49 @@ func (c *AuthenticatedVaultClient) Token() string {
 func (c *AuthenticatedVaultClient) CA() CA {
 	return NewCA(c.log, c.vaultClient, c.authMethods)
 }
+
+// RenewToken renews the current token of the vault client (if it is renewable).
+// It returns the remaining TTL of the token, where 0 means that the token does not expire.
+func (c *AuthenticatedVaultClient) RenewToken() (time.Duration, error) {
+	self, err := c.vaultClient.Auth().Token().LookupSelf()
+	if err != nil {
+		return 0, maskAny(errgo.WithCausef(nil, VaultError, "cannot lookup token: %s", err))
+	}
+	ttl, err := durationFromData(self.Data["ttl"])
+	if err != nil {
+		return 0, maskAny(err)
+	}
+	if ttl == 0 {
+		// Token never expires
+		return 0, nil
+	}
+	if renewable, _ := self.Data["renewable"].(bool); !renewable {
+		return ttl, nil
+	}
+	secret, err := c.vaultClient.Auth().Token().RenewSelf(0)
+	if err != nil {
+		return 0, maskAny(errgo.WithCausef(nil, VaultError, "cannot renew token: %s", err))
+	}
+	if secret == nil || secret.Auth == nil {
+		return 0, maskAny(errgo.WithCausef(nil, VaultError, "missing authentication in renew response"))
+	}
+	return time.Duration(secret.Auth.LeaseDuration) * time.Second, nil
+}
+
+// durationFromData converts a number of seconds, found in the data of a secret, into a duration.
+func durationFromData(value interface{}) (time.Duration, error) {
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		seconds, err := v.Int64()
+		if err != nil {
+			return 0, maskAny(err)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	case float64:
+		return time.Duration(v) * time.Second, nil
+	default:
+		return 0, maskAny(fmt.Errorf("Expected a number of seconds, got %v", value))
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/juju/errgo"
+)
+
+func init() {
+	RegisterLoginMethod(LoginMethodKubernetes, func(config VaultServiceConfig) (LoginMethod, error) {
+		mount := strings.Trim(config.KubernetesAuthMount, "/")
+		if mount == "" {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "kubernetes authentication requires --vault-kubernetes-auth-mount"))
+		}
+		jwtPath := config.KubernetesJWTPath
+		if jwtPath == "" {
+			jwtPath = DefaultKubernetesJWTPath
+		}
+		return kubernetesMethod{mount: mount, jwtPath: jwtPath}, nil
+	})
+}
+
+// kubernetesMethod implements the kubernetes (or JWT) authentication method, using the service account token of the pod.
+// Its roles are bound to service accounts, which is configured by the administrator of the vault,
+// so the provisioning hooks do nothing.
+type kubernetesMethod struct {
+	mount   string // Path of the kubernetes auth method mount
+	jwtPath string // Path of the service account token
+}
+
+// Name returns the name used to select the method.
+func (kubernetesMethod) Name() string {
+	return LoginMethodKubernetes
+}
+
+// RequiresSecret returns false, since the service account token is used instead of a secret.
+func (kubernetesMethod) RequiresSecret() bool {
+	return false
+}
+
+// Login attempts a kubernetes login using the service account token of the pod & given role.
+// The given secret is ignored.
+func (m kubernetesMethod) Login(vaultClient *api.Client, role string, secret interface{}) error {
+	jwt, err := readID(m.jwtPath)
+	if err != nil {
+		return maskAny(err)
+	}
+	vaultClient.ClearToken()
+	data := make(map[string]interface{})
+	data["role"] = role
+	data["jwt"] = jwt
+	loginSecret, err := vaultClient.Logical().Write(fmt.Sprintf("auth/%s/login", m.mount), data)
+	if err != nil {
+		return maskAny(err)
+	}
+	if err := loginResponse(vaultClient, loginSecret); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// CreateRole does nothing, since kubernetes roles must be bound to service accounts by the administrator.
+func (kubernetesMethod) CreateRole(vaultClient *api.Client, role, policyName string) error {
+	return nil
+}
+
+// DeleteRole does nothing, see CreateRole.
+func (kubernetesMethod) DeleteRole(vaultClient *api.Client, role string) error {
+	return nil
+}
+
+// AddSecret does nothing, since kubernetes logins do not use secrets.
+func (kubernetesMethod) AddSecret(vaultClient *api.Client, role string, secret interface{}, cidrBlock string) error {
+	return nil
+}
+
+// RemoveSecret does nothing, see AddSecret.
+func (kubernetesMethod) RemoveSecret(vaultClient *api.Client, role string, secret interface{}) error {
+	return nil
+}
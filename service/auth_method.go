@@ -14,17 +14,157 @@
 
 package service
 
-// AuthMethod specifies a mask of authentication methods.
-type AuthMethod uint
+import (
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/juju/errgo"
+)
 
 const (
-	// AuthMethodAppID indicates the app-id authentication method
-	AuthMethodAppID AuthMethod = 0x01
-	// AuthMethodAppRole indicates the approle authentication method
-	AuthMethodAppRole AuthMethod = 0x02
+	// LoginMethodAppRole is the name of the approle authentication method
+	LoginMethodAppRole = "approle"
+	// LoginMethodAppID is the name of the app-id authentication method
+	LoginMethodAppID = "app-id"
+	// LoginMethodKubernetes is the name of the kubernetes (service account JWT) authentication method
+	LoginMethodKubernetes = "kubernetes"
 )
 
-// IsEnabled returns true if the given specific authentication method is contained in the given mask.
-func (mask AuthMethod) IsEnabled(specific AuthMethod) bool {
-	return mask&specific == specific
+// LoginMethod is an authentication method used by the 2-step server login.
+// Besides the login itself, it provides the hooks used by Cluster & Job to provision
+// the roles & secrets needed to login.
+type LoginMethod interface {
+	// Name returns the name used to select the method (e.g. approle).
+	Name() string
+	// RequiresSecret returns true if the method logs in using a secret created during provisioning
+	// (the machine-id in step 1, the cluster/job specific user-id in step 2).
+	// Methods that use their own credentials (e.g. a service account token) are only used in step 1.
+	RequiresSecret() bool
+	// Login logs in to the given role using the given secret.
+	// On success, the token of the vault client is updated with the returned login token.
+	Login(vaultClient *api.Client, role string, secret interface{}) error
+	// CreateRole creates a role with given name that is granted the policy with given name.
+	CreateRole(vaultClient *api.Client, role, policyName string) error
+	// DeleteRole removes the role with given name.
+	DeleteRole(vaultClient *api.Client, role string) error
+	// AddSecret allows logging in to the given role using the given secret.
+	// If cidrBlock is set, logins are only allowed from addresses in that block.
+	AddSecret(vaultClient *api.Client, role string, secret interface{}, cidrBlock string) error
+	// RemoveSecret denies logging in to the given role using the given secret.
+	RemoveSecret(vaultClient *api.Client, role string, secret interface{}) error
+}
+
+// LoginMethodFactory creates a login method using the given configuration.
+type LoginMethodFactory func(config VaultServiceConfig) (LoginMethod, error)
+
+var (
+	loginMethods = make(map[string]LoginMethodFactory)
+)
+
+// RegisterLoginMethod registers a login method under the given name, so it can be selected
+// using --auth-methods. It must be called from an init function.
+func RegisterLoginMethod(name string, factory LoginMethodFactory) {
+	loginMethods[name] = factory
+}
+
+// LoginMethodNames returns the sorted names of all registered login methods.
+func LoginMethodNames() []string {
+	result := make([]string, 0, len(loginMethods))
+	for name := range loginMethods {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// NewLoginMethod creates the login method registered under the given name.
+func NewLoginMethod(name string, config VaultServiceConfig) (LoginMethod, error) {
+	factory, found := loginMethods[name]
+	if !found {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unknown authentication method '%s' (expected one of %s)", name, strings.Join(LoginMethodNames(), ", ")))
+	}
+	method, err := factory(config)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return method, nil
+}
+
+// newLoginMethods creates the login methods selected by the given configuration, in the order in which
+// they are attempted.
+// When no methods are selected explicitly, kubernetes (if its mount is set), approle & app-id are used.
+// Methods disabled using DisableAppRole or DisableAppID are always left out.
+// At least one of the resulting methods must log in using a secret, since step 2 requires one.
+func newLoginMethods(config VaultServiceConfig) ([]LoginMethod, error) {
+	names := config.AuthMethods
+	if len(names) == 0 {
+		if config.KubernetesAuthMount != "" {
+			names = append(names, LoginMethodKubernetes)
+		}
+		names = append(names, LoginMethodAppRole, LoginMethodAppID)
+	}
+	var result []LoginMethod
+	found := make(map[string]struct{})
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := found[name]; ok {
+			continue
+		}
+		found[name] = struct{}{}
+		if (name == LoginMethodAppRole && config.DisableAppRole) || (name == LoginMethodAppID && config.DisableAppID) {
+			continue
+		}
+		method, err := NewLoginMethod(name, config)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		result = append(result, method)
+	}
+	if !requiresSecret(result) {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "at least one authentication method that uses a secret (%s) is required for the second step of a server login", strings.Join(secretLoginMethodNames(config), ", ")))
+	}
+	return result, nil
+}
+
+// ValidateAuthMethods checks that the login methods selected by the given configuration can be created
+// and that at least one of them logs in using a secret.
+func ValidateAuthMethods(config VaultServiceConfig) error {
+	if _, err := newLoginMethods(config); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// requiresSecret returns true if one of the given methods logs in using a secret.
+func requiresSecret(methods []LoginMethod) bool {
+	for _, m := range methods {
+		if m.RequiresSecret() {
+			return true
+		}
+	}
+	return false
+}
+
+// secretLoginMethodNames returns the sorted names of all registered login methods that log in using a secret.
+func secretLoginMethodNames(config VaultServiceConfig) []string {
+	var result []string
+	for _, name := range LoginMethodNames() {
+		if m, err := NewLoginMethod(name, config); err == nil && m.RequiresSecret() {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// loginResponse sets the token of the vault client to the token of the given login response.
+func loginResponse(vaultClient *api.Client, loginSecret *api.Secret) error {
+	if loginSecret == nil || loginSecret.Auth == nil {
+		return maskAny(errgo.WithCausef(nil, VaultError, "missing authentication in secret response"))
+	}
+	vaultClient.SetToken(loginSecret.Auth.ClientToken)
+	return nil
 }
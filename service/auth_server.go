@@ -31,6 +31,9 @@ const (
 	jobIDEnvKey            = "VAULT_MONKEY_JOB_ID"
 	clusterIDEnvKey        = "VAULT_MONKEY_CLUSTER_ID"
 	machineIDEnvKey        = "VAULT_MONKEY_MACHINE_ID"
+
+	// DefaultKubernetesJWTPath is the path of the service account token that is mounted in every Kubernetes pod.
+	DefaultKubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
 )
 
 type ServerLoginData interface {
@@ -47,16 +50,12 @@ func (s *VaultService) ServerLogin(data ServerLoginData) (*AuthenticatedVaultCli
 		return nil, maskAny(err)
 	}
 	clusterID = strings.ToLower(clusterID)
-	machineID, err := data.MachineID()
-	if err != nil {
-		return nil, maskAny(err)
-	}
-	machineID = strings.ToLower(machineID)
 	jobID, err := data.JobID()
 	if err != nil {
 		return nil, maskAny(err)
 	}
-	jobID = strings.ToLower(jobID)
+	// A '@<version>' suffix selects a (pinned) version of the user-id mapping
+	jobID, version := splitSecretVersion(strings.ToLower(jobID))
 
 	// Prepare client
 	vaultClient, address, err := s.newUnsealedClient()
@@ -65,16 +64,15 @@ func (s *VaultService) ServerLogin(data ServerLoginData) (*AuthenticatedVaultCli
 	}
 
 	// Step 1
-	if err := s.serverLoginStep1(vaultClient, clusterID, machineID); err != nil {
+	if err := s.serverLoginStep1(vaultClient, clusterID, data); err != nil {
 		return nil, maskAny(err)
 	}
 
 	// Read cluster/job specific user-id
 	s.log.Debugf("Fetch cluster+job specific user-id at %s", address)
-	logical := vaultClient.Logical()
 	userIDPath := fmt.Sprintf(clusterAuthPathTmpl, clusterID, jobID)
-	s.log.Debugf("Fetch cluster+job specific user-id from %s", userIDPath)
-	userIDSecret, err := logical.Read(userIDPath)
+	s.log.Debugf("Fetch cluster+job specific user-id from %s", versionedPath(userIDPath, version))
+	userIDSecret, err := newKVClient(vaultClient).read(userIDPath, version)
 	if err != nil {
 		return nil, maskAny(err)
 	}
@@ -96,42 +94,53 @@ func (s *VaultService) ServerLogin(data ServerLoginData) (*AuthenticatedVaultCli
 	return client, nil
 }
 
-// serverLoginStep1 performs the first login step using app-id authentication.
-func (s *VaultService) serverLoginStep1(vaultClient *api.Client, clusterID, machineID string) error {
+// serverLoginStep1 performs the first login step, using the cluster ID as role.
+// The enabled login methods are attempted in order. Methods that require a secret use the machine ID,
+// which is only fetched when such a method is attempted.
+// If all methods fail, the failures of all methods are returned.
+func (s *VaultService) serverLoginStep1(vaultClient *api.Client, clusterID string, data ServerLoginData) error {
 	// Perform step 1 login
-	var err error
-	if s.authMethods.IsEnabled(AuthMethodAppRole) {
-		s.log.Debug("Step 1 approle login")
-		if err = s.appRoleLogin(vaultClient, clusterID, machineID); err == nil {
-			return nil
+	var machineID interface{}
+	var loginErrors []error
+	for _, m := range s.authMethods {
+		var secret interface{}
+		if m.RequiresSecret() {
+			if machineID == nil {
+				id, mErr := data.MachineID()
+				if mErr != nil {
+					// Report the failures of earlier (secretless) methods as well
+					return maskAny(aggregateErrors(append(loginErrors, mErr)))
+				}
+				machineID = strings.ToLower(id)
+			}
+			secret = machineID
 		}
-	}
-	if s.authMethods.IsEnabled(AuthMethodAppID) {
-		s.log.Debug("Step 1 app-id login")
-		if err = s.appIDLogin(vaultClient, clusterID, machineID); err == nil {
+		s.log.Debugf("Step 1 %s login", m.Name())
+		err := m.Login(vaultClient, clusterID, secret)
+		if err == nil {
 			return nil
 		}
+		s.log.Debugf("Step 1 %s login failed: %s", m.Name(), Describe(err))
+		loginErrors = append(loginErrors, errgo.Notef(err, "step 1 %s login failed", m.Name()))
 	}
-	if err == nil {
-		err = fmt.Errorf("No authentication method left")
+	if len(loginErrors) == 0 {
+		return maskAny(fmt.Errorf("No authentication method left"))
 	}
-	return maskAny(err)
+	return maskAny(aggregateErrors(loginErrors))
 }
 
-// serverLoginStep2 performs a the second step of the 2-step login using the app-id authentication method and
-// initializes the vaultClient with the resulting token.
+// serverLoginStep2 performs a the second step of the 2-step login using the job ID as role and the
+// cluster/job specific user-id as secret and initializes the vaultClient with the resulting token.
+// Only login methods that require a secret are attempted.
 func (s *VaultService) serverLoginStep2(vaultClient *api.Client, jobID string, userID interface{}) (*AuthenticatedVaultClient, error) {
 	// Perform step 2 login
-	s.log.Debug("Step 2 approle login")
 	var err error
-	if s.authMethods.IsEnabled(AuthMethodAppRole) {
-		if err = s.appRoleLogin(vaultClient, jobID, userID); err == nil {
-			return s.newAuthenticatedClient(vaultClient), nil
+	for _, m := range s.authMethods {
+		if !m.RequiresSecret() {
+			continue
 		}
-	}
-	if s.authMethods.IsEnabled(AuthMethodAppID) {
-		s.log.Debug("Step 2 app-id login")
-		if err = s.appIDLogin(vaultClient, jobID, userID); err == nil {
+		s.log.Debugf("Step 2 %s login", m.Name())
+		if err = m.Login(vaultClient, jobID, userID); err == nil {
 			return s.newAuthenticatedClient(vaultClient), nil
 		}
 	}
@@ -141,50 +150,6 @@ func (s *VaultService) serverLoginStep2(vaultClient *api.Client, jobID string, u
 	return nil, maskAny(err)
 }
 
-// appRoleLogin attempts an approle login uisng given roleID & secretID.
-// On success, the vaultclient's token is updated with the returned login token.
-func (s *VaultService) appRoleLogin(vaultClient *api.Client, roleID string, secretID interface{}) error {
-	vaultClient.ClearToken()
-	logical := vaultClient.Logical()
-	step2Data := make(map[string]interface{})
-	step2Data["role_id"] = roleID
-	step2Data["secret_id"] = secretID
-	if loginSecret, err := logical.Write("auth/approle/login", step2Data); err != nil {
-		return maskAny(err)
-	} else if loginSecret.Auth == nil {
-		return maskAny(errgo.WithCausef(nil, VaultError, "missing authentication in secret response"))
-	} else {
-		// Use step2 token
-		vaultClient.SetToken(loginSecret.Auth.ClientToken)
-	}
-
-	// We're done
-	return nil
-}
-
-// appIDLogin attempts an app-ID login uisng given appID & userID.
-// On success, the vaultclient's token is updated with the returned login token.
-func (s *VaultService) appIDLogin(vaultClient *api.Client, appID string, userID interface{}) error {
-	vaultClient.ClearToken()
-	logical := vaultClient.Logical()
-	//s.log.Debugf("app-id %s", jobID)
-	//s.log.Debugf("user-id %s", userId)
-	step2Data := make(map[string]interface{})
-	step2Data["app_id"] = appID
-	step2Data["user_id"] = userID
-	if loginSecret, err := logical.Write("auth/app-id/login", step2Data); err != nil {
-		return maskAny(err)
-	} else if loginSecret.Auth == nil {
-		return maskAny(errgo.WithCausef(nil, VaultError, "missing authentication in secret response"))
-	} else {
-		// Use step2 token
-		vaultClient.SetToken(loginSecret.Auth.ClientToken)
-	}
-
-	// We're done
-	return nil
-}
-
 type baseServerLoginData struct {
 	next ServerLoginData
 }
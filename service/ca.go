@@ -29,11 +29,14 @@ type CA interface {
 	// CreateK8s creates a CA that issues K8S member certificates for the various K8S components.
 	CreateK8s(clusterID, component, domainName string, force bool) error
 	// IssueETCDCertificate issues a new certificate for a specific service.
-	IssueETCDCertificate(clusterID string, config IssueConfig) error
+	// It returns true if any of the certificate files has changed.
+	IssueETCDCertificate(clusterID string, config IssueConfig) (bool, error)
 	// IssueK8sCertificate issues a new certificate for a specific service.
-	IssueK8sCertificate(clusterID string, config IssueConfig) error
+	// It returns true if any of the certificate files has changed.
+	IssueK8sCertificate(clusterID string, config IssueConfig) (bool, error)
 	// IssueCertificate issues a new certificate for a specific service.
-	IssueCertificate(clusterID, service string, config IssueConfig) error
+	// It returns true if any of the certificate files has changed.
+	IssueCertificate(clusterID, service string, config IssueConfig) (bool, error)
 	// ListETCDCertificates issues a new certificate for a specific service.
 	ListETCDCertificates(clusterID string) error
 	// ListK8sCertificates issues a new certificate for a specific service.
@@ -49,10 +52,11 @@ type CA interface {
 }
 
 // NewCA creates a new CA manipulator for the given vault client.
-func NewCA(log *logging.Logger, vaultClient *api.Client, methods AuthMethod) CA {
+func NewCA(log *logging.Logger, vaultClient *api.Client, methods []LoginMethod) CA {
 	return &ca{
 		log:         log,
 		vaultClient: vaultClient,
+		kv:          newKVClient(vaultClient),
 		methods:     methods,
 	}
 }
@@ -60,7 +64,8 @@ func NewCA(log *logging.Logger, vaultClient *api.Client, methods AuthMethod) CA
 type ca struct {
 	log         *logging.Logger
 	vaultClient *api.Client
-	methods     AuthMethod
+	kv          *kvClient
+	methods     []LoginMethod
 }
 
 // createMountPoint creates the mointpoint for the PKI secret backend in the vault, based on the given
@@ -167,7 +172,11 @@ func (c *ca) createK8sServiceAccountToken(clusterID string, force bool) error {
 		return maskAny(err)
 	}
 	// Create read secret policy
-	policy, err := c.createReadSecretPolicy(tokenSecretPath, compNameKubeServiceAccounts)
+	policyPath, err := c.kv.policyPath(tokenSecretPath)
+	if err != nil {
+		return maskAny(err)
+	}
+	policy, err := c.createReadSecretPolicy(policyPath, compNameKubeServiceAccounts)
 	if err != nil {
 		return maskAny(err)
 	}
@@ -189,7 +198,7 @@ func (c *ca) createK8sServiceAccountTokenSecret(secretPath string, force bool) e
 	secretField := "key"
 	if !force {
 		// Look if secret already exists
-		secret, err := c.vaultClient.Logical().Read(secretPath)
+		secret, err := c.kv.read(secretPath, 0)
 		if err != nil {
 			return maskAny(errgo.WithCausef(nil, VaultError, "error reading %s: %s", secretPath, err))
 		}
@@ -211,7 +220,7 @@ func (c *ca) createK8sServiceAccountTokenSecret(secretPath string, force bool) e
 	data := map[string]interface{}{
 		secretField: string(output),
 	}
-	if _, err := c.vaultClient.Logical().Write(secretPath, data); err != nil {
+	if err := c.kv.write(secretPath, data); err != nil {
 		return maskAny(err)
 	}
 	return nil
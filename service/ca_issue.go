@@ -25,6 +25,10 @@ type IssueConfig struct {
 	KeyFileName         string
 	CAFileName          string
 	FileMode            uint32
+	Owner               string // Name or uid of the owner of the created files
+	Group               string // Name or gid of the group of the created files
+	AllowPersistent     bool   // If set, the files may be written to a filesystem other than tmpfs or ramfs
+	RequireTmpfs        bool   // If set, the files must be written to tmpfs or ramfs
 }
 
 // SetupDefaults ensures all fields are set to their defaults if they are not yet set
@@ -53,35 +57,47 @@ func (config *IssueConfig) IssueIsNeeded(log *logging.Logger) bool {
 }
 
 // IssueETCDCertificate issues a new certificate for a specific service.
-func (c *ca) IssueETCDCertificate(clusterID string, config IssueConfig) error {
+func (c *ca) IssueETCDCertificate(clusterID string, config IssueConfig) (bool, error) {
 	if config.Role == "" {
 		config.Role = roleMember
 	}
-	if err := c.IssueCertificate(clusterID, "etcd", config); err != nil {
-		return maskAny(err)
+	changed, err := c.IssueCertificate(clusterID, "etcd", config)
+	if err != nil {
+		return false, maskAny(err)
 	}
-	return nil
+	return changed, nil
 }
 
 // IssueK8sCertificate issues a new certificate for a specific service.
-func (c *ca) IssueK8sCertificate(clusterID string, config IssueConfig) error {
+func (c *ca) IssueK8sCertificate(clusterID string, config IssueConfig) (bool, error) {
 	if config.Role == "" {
 		config.Role = roleOperations
 	}
-	if err := c.IssueCertificate(clusterID, "k8s", config); err != nil {
-		return maskAny(err)
+	changed, err := c.IssueCertificate(clusterID, "k8s", config)
+	if err != nil {
+		return false, maskAny(err)
 	}
-	return nil
+	return changed, nil
 }
 
 // IssueCertificate issues a new certificate for a specific service.
-func (c *ca) IssueCertificate(clusterID, service string, config IssueConfig) error {
+// It returns true if any of the certificate files has changed.
+func (c *ca) IssueCertificate(clusterID, service string, config IssueConfig) (bool, error) {
 	config.SetupDefaults(clusterID)
 	os.MkdirAll(config.OutputDir, 0755)
 	certPath := filepath.Join(config.OutputDir, config.CertificateFileName)
 	keyPath := filepath.Join(config.OutputDir, config.KeyFileName)
 	caPath := filepath.Join(config.OutputDir, config.CAFileName)
 
+	options := FileOptions{Owner: config.Owner, Group: config.Group, AllowPersistent: config.AllowPersistent, RequireTmpfs: config.RequireTmpfs}
+	if err := options.Validate(); err != nil {
+		return false, maskAny(err)
+	}
+	// Check the storage before issuing a certificate that cannot be written
+	if err := options.checkStorage(certPath); err != nil {
+		return false, maskAny(err)
+	}
+
 	mountPoint := c.createMountPoint(clusterID, service)
 	issuePath := path.Join(mountPoint, "issue", config.Role)
 
@@ -97,33 +113,42 @@ func (c *ca) IssueCertificate(clusterID, service string, config IssueConfig) err
 	}
 	secret, err := c.vaultClient.Logical().Write(issuePath, data)
 	if err != nil {
-		return maskAny(err)
+		return false, maskAny(err)
 	}
 
 	// Write output
 	mode := os.FileMode(config.FileMode)
-	if err := writeData(certPath, mode, secret.Data["certificate"]); err != nil {
-		return maskAny(err)
-	}
-	if err := writeData(keyPath, mode, secret.Data["private_key"]); err != nil {
-		return maskAny(err)
-	}
-	if err := writeData(caPath, mode, secret.Data["issuing_ca"]); err != nil {
-		return maskAny(err)
+	changed := false
+	for _, f := range []struct {
+		path string
+		key  string
+	}{
+		{certPath, "certificate"},
+		{keyPath, "private_key"},
+		{caPath, "issuing_ca"},
+	} {
+		fileChanged, err := writeData(f.path, mode, options, secret.Data[f.key])
+		if err != nil {
+			return false, maskAny(err)
+		}
+		changed = changed || fileChanged
 	}
 
-	return nil
+	return changed, nil
 }
 
-func writeData(filePath string, fileMode os.FileMode, data interface{}) error {
+// writeData atomically writes the given data into a file with given mode & ownership.
+// It returns true if the file has been written, false if it already had the same content.
+func writeData(filePath string, fileMode os.FileMode, options FileOptions, data interface{}) (bool, error) {
 	content, ok := data.(string)
 	if !ok {
-		return maskAny(fmt.Errorf("Expected data to be a string"))
+		return false, maskAny(fmt.Errorf("Expected data to be a string"))
 	}
-	if err := ioutil.WriteFile(filePath, []byte(content), fileMode); err != nil {
-		return maskAny(err)
+	changed, err := writeFileIfChanged(filePath, []byte(content), options, fileMode)
+	if err != nil {
+		return false, maskAny(err)
 	}
-	return nil
+	return changed, nil
 }
 
 func isValidCertificateSet(log *logging.Logger, certPath, keyPath, caPath, commonName string) bool {
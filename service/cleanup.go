@@ -0,0 +1,277 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"os"
+
+	"github.com/juju/errgo"
+	"github.com/op/go-logging"
+)
+
+// Cleanup securely removes all targets recorded in the state file, including those written by other processes.
+// Files are overwritten before they are removed and keys added to Kubernetes secrets & config maps are deleted.
+// The Kubernetes client is only needed when Kubernetes objects have been recorded.
+// Targets that cannot be removed remain in the state file, so a next cleanup can try again.
+func Cleanup(log *logging.Logger, k8sClient *K8sClient) error {
+	if stateDir == "" {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "no state directory set"))
+	}
+	var errors []error
+	if err := updateState(func(s *State) bool {
+		var removed State
+		removed, errors = cleanupTargets(log, k8sClient, *s)
+		return s.remove(removed)
+	}); err != nil {
+		return maskAny(err)
+	}
+	return aggregateErrors(errors)
+}
+
+// CleanupWrittenTargets securely removes the targets written by this process (see Cleanup).
+// Removed targets are also removed from the state file (if enabled).
+func CleanupWrittenTargets(log *logging.Logger, k8sClient *K8sClient) error {
+	processMutex.Lock()
+	targets := processState
+	processMutex.Unlock()
+	removed, errors := cleanupTargets(log, k8sClient, targets)
+	processMutex.Lock()
+	processState.remove(removed)
+	processMutex.Unlock()
+	if err := updateState(func(s *State) bool {
+		return s.remove(removed)
+	}); err != nil {
+		log.Warningf("Cannot remove cleaned up targets from state file in %s: %s", stateDir, Describe(err))
+	}
+	return aggregateErrors(errors)
+}
+
+// cleanupTargets securely removes the given targets.
+// It returns the targets that have been removed and all errors that occurred.
+func cleanupTargets(log *logging.Logger, k8sClient *K8sClient, targets State) (State, []error) {
+	var removed State
+	errors := []error{}
+	for _, path := range targets.Files {
+		if err := shredFile(path); err != nil {
+			log.Errorf("Cannot remove %s: %s", path, err)
+			errors = append(errors, maskAny(err))
+		} else {
+			log.Infof("Removed %s", path)
+			removed.Files = append(removed.Files, path)
+		}
+	}
+	for _, ks := range targets.KubernetesSecrets {
+		if err := k8sClient.deleteKubernetesSecretKeys(ks.Namespace, ks.Name, ks.Keys); err != nil {
+			log.Errorf("Cannot remove keys from kubernetes secret %s/%s: %s", ks.Namespace, ks.Name, err)
+			errors = append(errors, maskAny(err))
+		} else {
+			log.Infof("Removed keys %v from kubernetes secret %s/%s", ks.Keys, ks.Namespace, ks.Name)
+			removed.KubernetesSecrets = append(removed.KubernetesSecrets, ks)
+		}
+	}
+	for _, kc := range targets.KubernetesConfigMaps {
+		if err := k8sClient.deleteKubernetesConfigMapKeys(kc.Namespace, kc.Name, kc.Keys); err != nil {
+			log.Errorf("Cannot remove keys from kubernetes config map %s/%s: %s", kc.Namespace, kc.Name, err)
+			errors = append(errors, maskAny(err))
+		} else {
+			log.Infof("Removed keys %v from kubernetes config map %s/%s", kc.Keys, kc.Namespace, kc.Name)
+			removed.KubernetesConfigMaps = append(removed.KubernetesConfigMaps, kc)
+		}
+	}
+	return removed, errors
+}
+
+// remove removes the given targets from the state.
+// It returns true if anything has been removed.
+func (s *State) remove(targets State) bool {
+	changed := false
+	files := []string{}
+	for _, path := range s.Files {
+		if containsString(targets.Files, path) {
+			changed = true
+		} else {
+			files = append(files, path)
+		}
+	}
+	s.Files = files
+	var c1, c2 bool
+	s.KubernetesSecrets, c1 = removeKubernetesKeys(s.KubernetesSecrets, targets.KubernetesSecrets)
+	s.KubernetesConfigMaps, c2 = removeKubernetesKeys(s.KubernetesConfigMaps, targets.KubernetesConfigMaps)
+	return changed || c1 || c2
+}
+
+// removeKubernetesKeys removes the given keys from the given list. Entries without keys are removed.
+// It returns the updated list and true if anything has been removed.
+func removeKubernetesKeys(list, remove []StateKubernetesKeys) ([]StateKubernetesKeys, bool) {
+	changed := false
+	result := []StateKubernetesKeys{}
+	for _, entry := range list {
+		keys := []string{}
+		for _, key := range entry.Keys {
+			removed := false
+			for _, r := range remove {
+				if r.Namespace == entry.Namespace && r.Name == entry.Name && containsString(r.Keys, key) {
+					removed = true
+				}
+			}
+			if removed {
+				changed = true
+			} else {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) > 0 {
+			entry.Keys = keys
+			result = append(result, entry)
+		}
+	}
+	return result, changed
+}
+
+// containsString returns true if the given list contains the given value.
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateErrors returns nil for no errors, the error itself for a single error or an AggregateError.
+func aggregateErrors(errors []error) error {
+	switch len(errors) {
+	case 0:
+		return nil
+	case 1:
+		return errors[0]
+	default:
+		return &AggregateError{errors: errors}
+	}
+}
+
+// shredFile overwrites the content of the file with given path with zeros and removes it.
+// A file that no longer exists is ignored.
+func shredFile(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return maskAny(err)
+	}
+	if info.Mode().IsRegular() {
+		// Make sure the owner can write the file
+		if err := os.Chmod(path, info.Mode().Perm()|0200); err != nil {
+			return maskAny(err)
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return maskAny(err)
+		}
+		zeros := make([]byte, 4096)
+		for remaining := info.Size(); remaining > 0; {
+			n := int64(len(zeros))
+			if remaining < n {
+				n = remaining
+			}
+			if _, err := f.Write(zeros[:n]); err != nil {
+				f.Close()
+				return maskAny(err)
+			}
+			remaining -= n
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return maskAny(err)
+		}
+		if err := f.Close(); err != nil {
+			return maskAny(err)
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// deleteKubernetesSecretKeys deletes the given keys from the Kubernetes secret with given namespace & name.
+// A secret that no longer exists is ignored.
+func (c *K8sClient) deleteKubernetesSecretKeys(namespace, name string, keys []string) error {
+	if c == nil {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "kubernetes secret %s/%s recorded, but no kubernetes client available", namespace, name))
+	}
+	secret, err := c.c.GetSecret(namespace, name)
+	if isKubernetesNotFound(err) {
+		return nil
+	} else if err != nil {
+		return maskAny(errgo.WithCausef(nil, KubernetesError, "cannot get kubernetes secret %s/%s: %s", namespace, name, err))
+	}
+	// Setting a key to null in a merge patch removes it
+	data := make(map[string]interface{})
+	for _, key := range keys {
+		if _, found := secret.Data[key]; found {
+			data[key] = nil
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	// Updating the secret through the k8s-client drops its owner references, so patch it instead.
+	// The resource version makes the patch fail when the secret has been modified in the meantime.
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": secret.ResourceVersion,
+		},
+		"data": data,
+	}
+	path := k8sCoreAPIPathPrefix + namespace + "/secrets/" + name
+	if err := c.conn.do("PATCH", path, k8sStrategicMergePatch, patch, nil); err != nil {
+		return maskAny(errgo.WithCausef(nil, KubernetesError, "cannot update kubernetes secret %s/%s: %s", namespace, name, err))
+	}
+	return nil
+}
+
+// deleteKubernetesConfigMapKeys deletes the given keys from the Kubernetes config map with given namespace & name.
+// A config map that no longer exists is ignored.
+func (c *K8sClient) deleteKubernetesConfigMapKeys(namespace, name string, keys []string) error {
+	if c == nil {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "kubernetes config map %s/%s recorded, but no kubernetes client available", namespace, name))
+	}
+	path := k8sCoreAPIPathPrefix + namespace + "/configmaps/" + name
+	var configMap kubernetesConfigMap
+	if err := c.conn.do("GET", path, "", nil, &configMap); isKubernetesNotFound(err) {
+		return nil
+	} else if err != nil {
+		return maskAny(errgo.WithCausef(nil, KubernetesError, "cannot get kubernetes config map %s/%s: %s", namespace, name, err))
+	}
+	changed := false
+	for _, key := range keys {
+		if _, found := configMap.Data[key]; found {
+			delete(configMap.Data, key)
+			changed = true
+		}
+		if _, found := configMap.BinaryData[key]; found {
+			delete(configMap.BinaryData, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := c.conn.do("PUT", path, k8sJSONContentType, configMap, nil); err != nil {
+		return maskAny(errgo.WithCausef(nil, KubernetesError, "cannot update kubernetes config map %s/%s: %s", namespace, name, err))
+	}
+	return nil
+}
@@ -16,9 +16,13 @@ package service
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/hashicorp/vault/api"
+	"github.com/juju/errgo"
 )
 
 const (
@@ -26,96 +30,85 @@ const (
 path "%s/*" {
     policy = "read"
 }`
-	clusterPolicyNameTmpl = "cluster_auth_%s"
+	// clusterPolicyPinTmpl restricts reading the user-id mapping of a job to a single version (KV version 2 only).
+	clusterPolicyPinTmpl = `
+path "%s/job/%s" {
+    policy = "read"
+    allowed_parameters = {
+        "version" = ["%d"]
+    }
+    required_parameters = ["version"]
+}`
+	clusterPolicyNameTmpl   = "cluster_auth_%s"
+	clusterPolicyNamePrefix = "cluster_auth_"
+)
+
+var (
+	// clusterPolicyPinPattern matches the rules created using clusterPolicyPinTmpl.
+	clusterPolicyPinPattern = regexp.MustCompile(`path "[^"]*/job/([^"/]+)" \{\s*policy = "read"\s*allowed_parameters = \{\s*"version" = \["(\d+)"\]\s*\}\s*required_parameters = \["version"\]\s*\}`)
 )
 
 // Cluster contains all vault methods to configure secrets for a cluster.
 type Cluster interface {
-	// Create creates the app-id mapping for a cluster with given id.
+	// Create creates the authentication role for a cluster with given id.
 	// It also creates and uses a policy for accessing only the jobs within the cluster.
 	Create(clusterID string) error
-	// Delete removes the app-id mapping for a cluster with given id.
+	// Delete removes the authentication role for a cluster with given id.
 	// It also removes the policy for accessing only the jobs within the cluster.
 	Delete(clusterID string) error
-	// AddMachine creates the user-id mapping for adding a machine to a cluster.
+	// AddMachine adds the machine-id as secret of the cluster role, for adding a machine to a cluster.
 	AddMachine(clusterID, machineID, cidrBlock string) error
-	// RemoveMachine removes the user-id mapping for removing a machine from a cluster.
+	// RemoveMachine removes the machine-id secret of the cluster role, for removing a machine from a cluster.
 	RemoveMachine(clusterID, machineID string) error
+	// MigratePolicies rewrites the policies of all existing clusters whose paths do not match the
+	// KV version of the mount containing the cluster-auth data.
+	// It returns the IDs of the clusters whose policy has been rewritten.
+	MigratePolicies() ([]string, error)
 }
 
 // NewCluster creates a new Cluster manipulator for the given vault client.
-func NewCluster(vaultClient *api.Client, methods AuthMethod) Cluster {
+func NewCluster(vaultClient *api.Client, methods []LoginMethod) Cluster {
 	return &cluster{
 		vaultClient: vaultClient,
+		kv:          newKVClient(vaultClient),
 		methods:     methods,
 	}
 }
 
 type cluster struct {
 	vaultClient *api.Client
-	methods     AuthMethod
+	kv          *kvClient
+	methods     []LoginMethod
 }
 
-// Create creates the app-id mapping for a cluster with given id.
+// Create creates the authentication role for a cluster with given id, using all enabled login methods.
 // It also creates and uses a policy for accessing only the jobs within the cluster.
+// The policies of all other clusters are migrated as well (see MigratePolicies).
 func (c *cluster) Create(clusterID string) error {
 	clusterID = strings.ToLower(clusterID)
 	policyName, err := c.createClusterPolicy(clusterID)
 	if err != nil {
 		return maskAny(err)
 	}
-	if c.methods.IsEnabled(AuthMethodAppRole) {
-		// Create role
-		{
-			path := fmt.Sprintf("auth/approle/role/%s", clusterID)
-			data := make(map[string]interface{})
-			data["role_name"] = clusterID
-			data["bind_secret_id"] = true
-			data["policies"] = policyName
-			data["secret_id_num_uses"] = 0
-			if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
-				return maskAny(err)
-			}
-		}
-		// Set role_id
-		{
-			path := fmt.Sprintf("auth/approle/role/%s/role-id", clusterID)
-			data := make(map[string]interface{})
-			data["role_id"] = clusterID
-			if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
-				return maskAny(err)
-			}
-		}
-	}
-	if c.methods.IsEnabled(AuthMethodAppID) {
-		path := fmt.Sprintf("auth/app-id/map/app-id/%s", clusterID)
-		data := make(map[string]interface{})
-		data["value"] = policyName
-		data["display_name"] = clusterID
-		if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
+	for _, m := range c.methods {
+		if err := m.CreateRole(c.vaultClient, clusterID, policyName); err != nil {
 			return maskAny(err)
 		}
 	}
+	if _, err := c.MigratePolicies(); err != nil {
+		return maskAny(err)
+	}
 	return nil
 }
 
-// Delete removes the app-id mapping for a cluster with given id.
+// Delete removes the authentication role for a cluster with given id, using all enabled login methods.
 // It also removes the policy for accessing only the jobs within the cluster.
 func (c *cluster) Delete(clusterID string) error {
 	clusterID = strings.ToLower(clusterID)
-	if c.methods.IsEnabled(AuthMethodAppRole) {
-		path := fmt.Sprintf("auth/approle/role/%s", clusterID)
-		if _, err := c.vaultClient.Logical().Delete(path); err != nil {
-			return maskAny(err)
-		}
-	}
-	if c.methods.IsEnabled(AuthMethodAppID) {
-		path := fmt.Sprintf("auth/app-id/map/app-id/%s", clusterID)
-		if _, err := c.vaultClient.Logical().Delete(path); err != nil {
+	for _, m := range c.methods {
+		if err := m.DeleteRole(c.vaultClient, clusterID); err != nil {
 			return maskAny(err)
 		}
-		// TODO remove all user-id mappings for this cluster-id (don't see a way how yet)
-		// TODO remove all tokens created for this app-id (don't see a way how yet)
 	}
 	policyName := fmt.Sprintf(clusterPolicyNameTmpl, clusterID)
 	if err := c.vaultClient.Sys().DeletePolicy(policyName); err != nil {
@@ -125,65 +118,147 @@ func (c *cluster) Delete(clusterID string) error {
 	return nil
 }
 
-// AddMachine creates the user-id mapping for adding a machine to a cluster.
+// AddMachine adds the machine-id as secret of the cluster role, for adding a machine to a cluster.
 func (c *cluster) AddMachine(clusterID, machineID, cidrBlock string) error {
 	clusterID = strings.ToLower(clusterID)
 	machineID = strings.ToLower(machineID)
-	if c.methods.IsEnabled(AuthMethodAppRole) {
-		path := fmt.Sprintf("auth/approle/role/%s/custom-secret-id", clusterID)
-		data := make(map[string]interface{})
-		data["secret_id"] = machineID
-		if cidrBlock != "" {
-			data["cidr_list"] = cidrBlock
-		}
-		if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
-			return maskAny(err)
-		}
-	}
-	if c.methods.IsEnabled(AuthMethodAppID) {
-		path := fmt.Sprintf("auth/app-id/map/user-id/%s", machineID)
-		data := make(map[string]interface{})
-		data["value"] = clusterID
-		if cidrBlock != "" {
-			data["cidr_block"] = cidrBlock
-		}
-		if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
+	for _, m := range c.methods {
+		if err := m.AddSecret(c.vaultClient, clusterID, machineID, cidrBlock); err != nil {
 			return maskAny(err)
 		}
 	}
 	return nil
 }
 
-// RemoveMachine removes the user-id mapping for removing a machine from a cluster.
+// RemoveMachine removes the machine-id secret of the cluster role, for removing a machine from a cluster.
 func (c *cluster) RemoveMachine(clusterID, machineID string) error {
 	clusterID = strings.ToLower(clusterID)
 	machineID = strings.ToLower(machineID)
-	if c.methods.IsEnabled(AuthMethodAppRole) {
-		path := fmt.Sprintf("/auth/approle/role/%s/secret-id/destroy", clusterID)
-		data := make(map[string]interface{})
-		data["secret_id"] = machineID
-		if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
+	for _, m := range c.methods {
+		if err := m.RemoveSecret(c.vaultClient, clusterID, machineID); err != nil {
 			return maskAny(err)
 		}
 	}
-	if c.methods.IsEnabled(AuthMethodAppID) {
-		path := fmt.Sprintf("auth/app-id/map/user-id/%s", machineID)
-		if _, err := c.vaultClient.Logical().Delete(path); err != nil {
-			return maskAny(err)
+	return nil
+}
+
+// MigratePolicies rewrites the policies of all existing clusters whose paths do not match the
+// KV version of the mount containing the cluster-auth data, e.g. after that mount has been upgraded to KV version 2.
+// It returns the IDs of the clusters whose policy has been rewritten.
+func (c *cluster) MigratePolicies() ([]string, error) {
+	names, err := c.vaultClient.Sys().ListPolicies()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	sort.Strings(names)
+	var result []string
+	for _, name := range names {
+		if !strings.HasPrefix(name, clusterPolicyNamePrefix) {
+			continue
+		}
+		clusterID := strings.TrimPrefix(name, clusterPolicyNamePrefix)
+		updated, err := updateClusterPolicy(c.vaultClient, c.kv, clusterID, nil)
+		if err != nil {
+			return result, maskAny(err)
+		}
+		if updated {
+			result = append(result, clusterID)
 		}
 	}
-	return nil
+	return result, nil
 }
 
 // createClusterPolicy creates and writes a policy into the vault for accessing the
 // cluster-auth data of the first step of the server authentication.
+// Versions pinned in an existing policy are kept.
 // It returns the policy name and any error.
 func (c *cluster) createClusterPolicy(clusterID string) (string, error) {
 	clusterID = strings.ToLower(clusterID)
-	policy := fmt.Sprintf(clusterPolicyTmpl, clusterAuthPathPrefix+clusterID)
 	policyName := fmt.Sprintf(clusterPolicyNameTmpl, clusterID)
-	if err := c.vaultClient.Sys().PutPolicy(policyName, policy); err != nil {
+	current, err := c.vaultClient.Sys().GetPolicy(policyName)
+	if err != nil {
+		return "", maskAny(err)
+	}
+	policy, err := clusterPolicy(c.kv, clusterID, clusterPolicyPins(current))
+	if err != nil {
 		return "", maskAny(err)
 	}
+	if policy != current {
+		if err := c.vaultClient.Sys().PutPolicy(policyName, policy); err != nil {
+			return "", maskAny(err)
+		}
+	}
 	return policyName, nil
 }
+
+// clusterPolicy returns the content of the policy for accessing the cluster-auth data of the cluster with given id.
+// The paths in the policy match the KV version of the mount containing the cluster-auth data.
+// The given pins (job ID -> version) restrict the user-id mapping of those jobs to a single version.
+func clusterPolicy(kv *kvClient, clusterID string, pins map[string]int) (string, error) {
+	clusterID = strings.ToLower(clusterID)
+	policyPath, err := kv.policyPath(clusterAuthPathPrefix + clusterID)
+	if err != nil {
+		return "", maskAny(err)
+	}
+	policy := fmt.Sprintf(clusterPolicyTmpl, policyPath)
+	jobIDs := make([]string, 0, len(pins))
+	for jobID := range pins {
+		jobIDs = append(jobIDs, jobID)
+	}
+	sort.Strings(jobIDs)
+	for _, jobID := range jobIDs {
+		policy += fmt.Sprintf(clusterPolicyPinTmpl, policyPath, jobID, pins[jobID])
+	}
+	return policy, nil
+}
+
+// clusterPolicyPins returns the versions (job ID -> version) pinned in the given cluster policy.
+func clusterPolicyPins(policy string) map[string]int {
+	pins := make(map[string]int)
+	for _, m := range clusterPolicyPinPattern.FindAllStringSubmatch(policy, -1) {
+		if version, err := strconv.Atoi(m[2]); err == nil {
+			pins[m[1]] = version
+		}
+	}
+	return pins
+}
+
+// updateClusterPolicy rewrites an existing policy of the cluster with given id when its content
+// is outdated, e.g. when it has been written using version 1 paths, while the cluster-auth data
+// is now stored in a KV version 2 mount.
+// If given, changePins is called to modify the pinned versions (job ID -> version) before the policy is created.
+// Clusters without a policy are left alone.
+// It returns true if the policy has been rewritten.
+func updateClusterPolicy(vaultClient *api.Client, kv *kvClient, clusterID string, changePins func(pins map[string]int)) (bool, error) {
+	clusterID = strings.ToLower(clusterID)
+	policyName := fmt.Sprintf(clusterPolicyNameTmpl, clusterID)
+	current, err := vaultClient.Sys().GetPolicy(policyName)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	if current == "" {
+		return false, nil
+	}
+	pins := clusterPolicyPins(current)
+	if changePins != nil {
+		changePins(pins)
+	}
+	if len(pins) > 0 {
+		if _, kvVersion, err := kv.mountOf(clusterAuthPathPrefix + clusterID); err != nil {
+			return false, maskAny(err)
+		} else if kvVersion < 2 {
+			return false, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot pin versions of the cluster-auth data of cluster %s, versions are only supported by KV version 2", clusterID))
+		}
+	}
+	policy, err := clusterPolicy(kv, clusterID, pins)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	if current == policy {
+		return false, nil
+	}
+	if err := vaultClient.Sys().PutPolicy(policyName, policy); err != nil {
+		return false, maskAny(err)
+	}
+	return true, nil
+}
@@ -17,7 +17,6 @@ package service
 import (
 	"bytes"
 	"html/template"
-	"io/ioutil"
 
 	"github.com/giantswarm/retry-go"
 	"github.com/hashicorp/vault/api"
@@ -31,8 +30,13 @@ type TokenConfig struct {
 }
 
 // CreateTokenFile creates a new token with given config and stores it in a file.
-func (c *AuthenticatedVaultClient) CreateTokenFile(path string, tokenConfig TokenConfig) error {
-	if err := ensureDirectoryOf(path, 0755); err != nil {
+// The file is written atomically, with the mode & ownership specified in the given options.
+func (c *AuthenticatedVaultClient) CreateTokenFile(path string, tokenConfig TokenConfig, options FileOptions) error {
+	if err := options.Validate(); err != nil {
+		return maskAny(err)
+	}
+	// Check the storage before creating a token that cannot be written
+	if err := options.checkStorage(path); err != nil {
 		return maskAny(err)
 	}
 	req := &api.TokenCreateRequest{
@@ -85,7 +89,7 @@ func (c *AuthenticatedVaultClient) CreateTokenFile(path string, tokenConfig Toke
 		content = buffer.Bytes()
 	}
 
-	if err := ioutil.WriteFile(path, content, 0400); err != nil {
+	if err := writeSecretFile(path, content, options); err != nil {
 		return maskAny(err)
 	}
 	return nil
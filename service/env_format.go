@@ -0,0 +1,266 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// DefaultEnvFormatName is the name of the format used when no format is specified.
+	DefaultEnvFormatName = "plain"
+)
+
+// EnvVar is a single key/value pair written into an environment file.
+type EnvVar struct {
+	Key   string
+	Value string
+}
+
+// EnvFormat formats key/value pairs into the content of an environment file.
+type EnvFormat interface {
+	// Name returns the name of the format, as used to select it.
+	Name() string
+	// Format returns the content of an environment file containing the given key/value pairs.
+	Format(vars []EnvVar) ([]byte, error)
+}
+
+var (
+	envFormatsMutex sync.Mutex
+	envFormats      = make(map[string]EnvFormat)
+	envKeyPattern   = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+)
+
+func init() {
+	RegisterEnvFormat(plainEnvFormat{})
+	RegisterEnvFormat(systemdEnvFormat{})
+	RegisterEnvFormat(dockerEnvFormat{})
+	RegisterEnvFormat(shellEnvFormat{})
+	RegisterEnvFormat(jsonEnvFormat{})
+	RegisterEnvFormat(yamlEnvFormat{})
+	RegisterEnvFormat(propertiesEnvFormat{})
+}
+
+// RegisterEnvFormat registers the given format, such that it can be found by its name.
+// A format registered earlier with the same name is replaced.
+func RegisterEnvFormat(format EnvFormat) {
+	envFormatsMutex.Lock()
+	defer envFormatsMutex.Unlock()
+	envFormats[format.Name()] = format
+}
+
+// GetEnvFormat returns the format registered with given name.
+// An empty name results in the default format.
+func GetEnvFormat(name string) (EnvFormat, error) {
+	if name == "" {
+		name = DefaultEnvFormatName
+	}
+	envFormatsMutex.Lock()
+	defer envFormatsMutex.Unlock()
+	format, ok := envFormats[name]
+	if !ok {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unknown format '%s'", name))
+	}
+	return format, nil
+}
+
+// EnvFormatNames returns the sorted names of all registered formats.
+func EnvFormatNames() []string {
+	envFormatsMutex.Lock()
+	defer envFormatsMutex.Unlock()
+	names := make([]string, 0, len(envFormats))
+	for name := range envFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateEnvKeys returns an error if one of the keys of the given variables is not
+// a valid environment variable name.
+func validateEnvKeys(vars []EnvVar) error {
+	for _, v := range vars {
+		if !envKeyPattern.MatchString(v.Key) {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "'%s' is not a valid environment variable name", v.Key))
+		}
+	}
+	return nil
+}
+
+// plainEnvFormat writes key=value lines without any quoting.
+type plainEnvFormat struct{}
+
+func (plainEnvFormat) Name() string { return "plain" }
+
+func (plainEnvFormat) Format(vars []EnvVar) ([]byte, error) {
+	lines := []string{}
+	for _, v := range vars {
+		lines = append(lines, fmt.Sprintf("%s=%s", v.Key, v.Value))
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// systemdEnvFormat writes key="value" lines as understood by systemd's EnvironmentFile.
+type systemdEnvFormat struct{}
+
+func (systemdEnvFormat) Name() string { return "systemd" }
+
+func (systemdEnvFormat) Format(vars []EnvVar) ([]byte, error) {
+	if err := validateEnvKeys(vars); err != nil {
+		return nil, maskAny(err)
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+	var buf bytes.Buffer
+	for _, v := range vars {
+		fmt.Fprintf(&buf, "%s=\"%s\"\n", v.Key, replacer.Replace(v.Value))
+	}
+	return buf.Bytes(), nil
+}
+
+// dockerEnvFormat writes key=value lines as understood by `docker --env-file`.
+// Docker does not support any quoting, so values cannot span multiple lines.
+type dockerEnvFormat struct{}
+
+func (dockerEnvFormat) Name() string { return "docker" }
+
+func (dockerEnvFormat) Format(vars []EnvVar) ([]byte, error) {
+	if err := validateEnvKeys(vars); err != nil {
+		return nil, maskAny(err)
+	}
+	var buf bytes.Buffer
+	for _, v := range vars {
+		if strings.ContainsAny(v.Value, "\r\n") {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "value of '%s' contains a newline, which is not supported by the docker format", v.Key))
+		}
+		fmt.Fprintf(&buf, "%s=%s\n", v.Key, v.Value)
+	}
+	return buf.Bytes(), nil
+}
+
+// shellEnvFormat writes POSIX shell `export key='value'` lines.
+type shellEnvFormat struct{}
+
+func (shellEnvFormat) Name() string { return "shell" }
+
+func (shellEnvFormat) Format(vars []EnvVar) ([]byte, error) {
+	if err := validateEnvKeys(vars); err != nil {
+		return nil, maskAny(err)
+	}
+	var buf bytes.Buffer
+	for _, v := range vars {
+		fmt.Fprintf(&buf, "export %s='%s'\n", v.Key, strings.Replace(v.Value, "'", `'\''`, -1))
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonEnvFormat writes a JSON object with a field per key.
+type jsonEnvFormat struct{}
+
+func (jsonEnvFormat) Name() string { return "json" }
+
+func (jsonEnvFormat) Format(vars []EnvVar) ([]byte, error) {
+	obj := make(map[string]string)
+	for _, v := range vars {
+		obj[v.Key] = v.Value
+	}
+	raw, err := json.MarshalIndent(obj, "", "  ")
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return append(raw, '\n'), nil
+}
+
+// yamlEnvFormat writes a YAML mapping with a double quoted value per key.
+type yamlEnvFormat struct{}
+
+func (yamlEnvFormat) Name() string { return "yaml" }
+
+func (yamlEnvFormat) Format(vars []EnvVar) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, v := range vars {
+		// A JSON string is a valid YAML double quoted scalar
+		key, err := json.Marshal(v.Key)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		value, err := json.Marshal(v.Value)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", key, value)
+	}
+	return buf.Bytes(), nil
+}
+
+// propertiesEnvFormat writes key=value lines as understood by java.util.Properties.
+type propertiesEnvFormat struct{}
+
+func (propertiesEnvFormat) Name() string { return "properties" }
+
+func (propertiesEnvFormat) Format(vars []EnvVar) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, v := range vars {
+		fmt.Fprintf(&buf, "%s=%s\n", escapeProperty(v.Key, true), escapeProperty(v.Value, false))
+	}
+	return buf.Bytes(), nil
+}
+
+// escapeProperty escapes the given string for use in a Java properties file (ISO 8859-1 encoded).
+func escapeProperty(s string, isKey bool) string {
+	var buf bytes.Buffer
+	for i, r := range s {
+		switch r {
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '=', ':', '#', '!':
+			buf.WriteRune('\\')
+			buf.WriteRune(r)
+		case ' ':
+			if isKey || i == 0 {
+				buf.WriteRune('\\')
+			}
+			buf.WriteRune(r)
+		default:
+			if r < 0x20 || r > 0x7e {
+				if r > 0xffff {
+					// Write as UTF-16 surrogate pair
+					r -= 0x10000
+					fmt.Fprintf(&buf, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+				} else {
+					fmt.Fprintf(&buf, `\u%04x`, r)
+				}
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	return buf.String()
+}
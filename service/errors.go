@@ -23,20 +23,30 @@ import (
 )
 
 var (
-	InvalidArgumentError = errgo.New("invalid argument")
-	VaultError           = errgo.New("vault error")
-	SecretNotFoundError  = errgo.New("secret not found")
-	maskAny              = errgo.MaskFunc(errgo.Any)
+	InvalidArgumentError   = errgo.New("invalid argument")
+	VaultError             = errgo.New("vault error")
+	SecretNotFoundError    = errgo.New("secret not found")
+	KubernetesError        = errgo.New("kubernetes error")
+	PersistentStorageError = errgo.New("persistent storage")
+	maskAny                = errgo.MaskFunc(errgo.Any)
 )
 
 func IsVault(err error) bool {
 	return errgo.Cause(err) == VaultError
 }
 
+func IsKubernetes(err error) bool {
+	return errgo.Cause(err) == KubernetesError
+}
+
 func IsSecretNotFound(err error) bool {
 	return errgo.Cause(err) == SecretNotFoundError
 }
 
+func IsPersistentStorage(err error) bool {
+	return errgo.Cause(err) == PersistentStorageError
+}
+
 type AggregateError struct {
 	errors []error
 }
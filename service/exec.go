@@ -0,0 +1,258 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+
+	"github.com/juju/errgo"
+	"github.com/op/go-logging"
+)
+
+var (
+	// forwardedSignals contains all signals that are forwarded to the child process by Exec.
+	forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGUSR1, syscall.SIGUSR2}
+)
+
+// ExecConfig holds the settings of Exec.
+type ExecConfig struct {
+	Secrets         []EnvSecret   // Secrets to add to the environment of the child process
+	Command         string        // Command to run
+	Args            []string      // Arguments of the command
+	RestartOnChange bool          // If set, the child process is restarted when a secret has changed
+	ChangeSignal    os.Signal     // If set (and RestartOnChange is not), this signal is sent to the child process when a secret has changed
+	Interval        time.Duration // Time between 2 checks for changed secrets or 2 lease renewals (must be positive)
+	RevokeLeases    bool          // If set, the leases of all dynamic secrets are revoked when the child process has terminated
+}
+
+// Exec logs in, extracts the configured secrets, and runs the configured command with those secrets
+// added to its environment. Signals received by this process are forwarded to the child process.
+// It returns the exit code of the child process.
+func Exec(log *logging.Logger, login LoginFunc, config ExecConfig) (int, error) {
+	if config.Command == "" {
+		return 0, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "command not set"))
+	}
+
+	// Login & extract secrets
+	c, err := login()
+	if err != nil {
+		return 0, maskAny(err)
+	}
+	vars, err := c.extractEnvSecrets(config.Secrets)
+	if err != nil {
+		return 0, maskAny(err)
+	}
+
+	// Forward signals
+	sigs := make(chan os.Signal, 16)
+	signal.Notify(sigs, forwardedSignals...)
+	defer signal.Stop(sigs)
+
+	// Start child
+	cmd, exited, err := startChild(config, vars)
+	if err != nil {
+		return 0, maskAny(err)
+	}
+
+	// Watch for changes (if needed)
+	var changes chan []EnvVar
+	if config.RestartOnChange || config.ChangeSignal != nil {
+		changes = make(chan []EnvVar, 1)
+		stopWatch := make(chan struct{})
+		watchDone := make(chan struct{})
+		defer func() {
+			// Stop watching & wait until leases have been revoked
+			close(stopWatch)
+			<-watchDone
+		}()
+		target := &envChangeTarget{secrets: config.Secrets, last: vars, changes: changes}
+		first := c
+		watchLogin := func() (*AuthenticatedVaultClient, error) {
+			// Re-use the existing login first
+			if first != nil {
+				result := first
+				first = nil
+				return result, nil
+			}
+			return login()
+		}
+		watchConfig := WatchConfig{
+			Interval:           config.Interval,
+			RevokeLeasesOnStop: config.RevokeLeases,
+		}
+		go func() {
+			defer close(watchDone)
+			Watch(log, watchLogin, watchConfig, stopWatch, target)
+		}()
+	} else if c.leases.hasLeases() {
+		// The child cannot pick up re-issued secrets, so keep its leases alive as long as possible
+		stopRenew := make(chan struct{})
+		renewDone := make(chan struct{})
+		defer func() {
+			close(stopRenew)
+			<-renewDone
+			if config.RevokeLeases {
+				c.RevokeLeases()
+			}
+		}()
+		go func() {
+			defer close(renewDone)
+			keepLeasesAlive(log, c, config.Interval, stopRenew)
+		}()
+	} else if config.RevokeLeases {
+		defer c.RevokeLeases()
+	}
+
+	restarting := false
+	for {
+		select {
+		case sig := <-sigs:
+			log.Debugf("Forwarding %s to child process", sig)
+			if err := cmd.Process.Signal(sig); err != nil {
+				log.Warningf("Failed to forward %s to child process: %s", sig, Describe(err))
+			}
+		case err := <-exited:
+			if restarting {
+				restarting = false
+				log.Infof("Restarting %s", config.Command)
+				if cmd, exited, err = startChild(config, vars); err != nil {
+					return 0, maskAny(err)
+				}
+				continue
+			}
+			return exitCode(err)
+		case newVars := <-changes:
+			vars = newVars
+			if config.RestartOnChange {
+				log.Infof("Secrets changed, stopping child process for restart")
+				restarting = true
+				if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+					log.Warningf("Failed to stop child process: %s", Describe(err))
+				}
+			} else {
+				log.Infof("Secrets changed, sending %s to child process", config.ChangeSignal)
+				if err := cmd.Process.Signal(config.ChangeSignal); err != nil {
+					log.Warningf("Failed to send %s to child process: %s", config.ChangeSignal, Describe(err))
+				}
+			}
+		}
+	}
+}
+
+// keepLeasesAlive renews the token of the given client and the leases of its dynamic secrets
+// until the given stop channel is closed, or until the leases can no longer be renewed.
+// Secrets are never re-issued, since their consumer cannot pick up new values.
+func keepLeasesAlive(log *logging.Logger, c *AuthenticatedVaultClient, interval time.Duration, stop <-chan struct{}) {
+	for {
+		ttl, err := c.RenewToken()
+		if err != nil {
+			log.Warningf("Token renewal failed, leases can no longer be renewed: %s", Describe(err))
+			return
+		}
+		leaseTTL := c.renewLeases(false)
+		if leaseTTL == 0 {
+			log.Debugf("No more leases to renew")
+			return
+		}
+		wait := interval
+		if leaseTTL < wait {
+			wait = leaseTTL
+		}
+		if ttl > 0 && ttl/2 < wait {
+			// Renew the token before it expires
+			wait = ttl / 2
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+			// Continue
+		}
+	}
+}
+
+// startChild starts the configured command with the given variables added to its environment.
+// It returns the command and a channel that receives the result of waiting for the command.
+func startChild(config ExecConfig, vars []EnvVar) (*exec.Cmd, chan error, error) {
+	cmd := exec.Command(config.Command, config.Args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	for _, v := range vars {
+		cmd.Env = append(cmd.Env, v.Key+"="+v.Value)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, maskAny(err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	return cmd, exited, nil
+}
+
+// exitCode converts the result of waiting for a child process into an exit code.
+// A child that is terminated by a signal results in 128 + signal number, like shells do.
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				return 128 + int(status.Signal()), nil
+			}
+			return status.ExitStatus(), nil
+		}
+	}
+	return 0, maskAny(err)
+}
+
+// envChangeTarget is a WatchTarget that reports changed environment secrets on a channel.
+type envChangeTarget struct {
+	secrets []EnvSecret
+	last    []EnvVar
+	changes chan []EnvVar
+}
+
+// Update extracts the secrets and reports them when they have changed.
+func (t *envChangeTarget) Update(c *AuthenticatedVaultClient) (bool, error) {
+	vars, err := c.extractEnvSecrets(t.secrets)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	if reflect.DeepEqual(vars, t.last) {
+		return false, nil
+	}
+	t.last = vars
+	// Replace any change that has not been processed yet
+	select {
+	case <-t.changes:
+	default:
+	}
+	t.changes <- vars
+	return true, nil
+}
+
+// String returns a human readable description of the target.
+func (t *envChangeTarget) String() string {
+	return "child process environment"
+}
@@ -15,32 +15,154 @@
 package service
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/vault/api"
 	"github.com/juju/errgo"
 )
 
+const (
+	// fieldFilterSeparator separates a field name from the filters that are applied to its value (field|filter).
+	fieldFilterSeparator = "|"
+)
+
+var (
+	// fieldFilters contains all filters that can be applied to the value of a field (field|filter).
+	fieldFilters = map[string]func(string) (string, error){
+		"base64d": decodeBase64,
+	}
+)
+
 // extractSecret extracts a secret based on given variables
 // Call a login method before calling this method.
 func (c *AuthenticatedVaultClient) extractSecret(secretPath, secretField string) (string, error) {
-	if secretPath == "" {
-		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "path not set"))
-	}
-	if secretField == "" {
+	// Split field into name and filters
+	filters := strings.Split(secretField, fieldFilterSeparator)
+	fieldName := strings.TrimSpace(filters[0])
+	filters = filters[1:]
+	if fieldName == "" {
 		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "field not set"))
 	}
+	for _, name := range filters {
+		if _, ok := fieldFilters[strings.TrimSpace(name)]; !ok {
+			return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unknown filter '%s' in field '%s'", name, secretField))
+		}
+	}
 
 	// Load secret
 	c.log.Infof("Read %s#%s", secretPath, secretField)
-	secret, err := c.vaultClient.Logical().Read(secretPath)
+	secret, err := c.readSecret(secretPath)
 	if err != nil {
-		return "", maskAny(errgo.WithCausef(nil, VaultError, "error reading %s: %s", secretPath, err))
+		return "", maskAny(err)
+	}
+
+	raw, ok := secret.Data[fieldName]
+	if !ok {
+		return "", maskAny(errgo.WithCausef(nil, SecretNotFoundError, "no field '%s' found at %s", fieldName, secretPath))
+	}
+	value, err := formatSecretValue(raw)
+	if err != nil {
+		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot format field '%s' at %s: %s", fieldName, secretPath, err))
+	}
+	for _, name := range filters {
+		if value, err = fieldFilters[strings.TrimSpace(name)](value); err != nil {
+			return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot apply '%s' to field '%s' at %s: %s", name, fieldName, secretPath, err))
+		}
+	}
+	return value, nil
+}
+
+// extractSecretFields extracts all fields of a secret at the given path.
+// Call a login method before calling this method.
+func (c *AuthenticatedVaultClient) extractSecretFields(secretPath string) (map[string]string, error) {
+	// Load secret
+	c.log.Infof("Read %s#*", secretPath)
+	secret, err := c.readSecret(secretPath)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	result := make(map[string]string)
+	for field, raw := range secret.Data {
+		value, err := formatSecretValue(raw)
+		if err != nil {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot format field '%s' at %s: %s", field, secretPath, err))
+		}
+		result[field] = value
+	}
+	return result, nil
+}
+
+// readSecret reads the secret at the given path ('<path>[@<version>]').
+// Secrets with a lease are cached until their lease has to be renewed.
+// It returns an error if there is no such secret.
+func (c *AuthenticatedVaultClient) readSecret(secretPath string) (*api.Secret, error) {
+	if secretPath == "" {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "path not set"))
+	}
+	if secret := c.leases.get(secretPath); secret != nil {
+		// Re-use dynamic secret, reading it again would issue new credentials
+		return secret, nil
+	}
+	path, version := splitSecretVersion(secretPath)
+	secret, err := c.kv.read(path, version)
+	if err != nil {
+		return nil, maskAny(errgo.WithCausef(nil, VaultError, "error reading %s: %s", secretPath, err))
 	}
 	if secret == nil {
-		return "", maskAny(errgo.WithCausef(nil, SecretNotFoundError, "no value found at %s", secretPath))
+		return nil, maskAny(errgo.WithCausef(nil, SecretNotFoundError, "no value found at %s", secretPath))
+	}
+	if secret.LeaseID != "" {
+		c.log.Debugf("Secret at %s has a lease of %ds", secretPath, secret.LeaseDuration)
+		c.leases.add(secretPath, secret)
+	}
+	return secret, nil
+}
+
+// formatSecretValue converts the value of a secret field into a string.
+// Strings are returned as is, numbers and booleans are formatted canonically,
+// maps & lists are formatted as JSON and a missing (null) value results in an empty string.
+func formatSecretValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return strconv.FormatInt(i, 10), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return "", maskAny(err)
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	default:
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return "", maskAny(err)
+		}
+		return string(raw), nil
 	}
+}
 
-	if value, ok := secret.Data[secretField]; !ok {
-		return "", maskAny(errgo.WithCausef(nil, SecretNotFoundError, "no field '%s' found at %s", secretField, secretPath))
-	} else {
-		return value.(string), nil
+// decodeBase64 decodes a standard base64 encoded value.
+// The result can contain binary data.
+func decodeBase64(value string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid base64 value: %s", err))
 	}
+	return string(raw), nil
 }
@@ -0,0 +1,201 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/giantswarm/retry-go"
+	"github.com/juju/errgo"
+)
+
+// DirSecret specifies a subtree of secrets that is extracted into a directory.
+type DirSecret struct {
+	SecretPath string // Path of the root of the subtree
+	// SecretField selects a single field of every secret, which is then written into a file named after the secret.
+	// If empty, all fields of every secret are written into a directory named after the secret,
+	// containing a file per field.
+	SecretField string
+}
+
+// CreateSecretDirectory extracts all secrets in a subtree and creates a file per secret (field)
+// in the given directory, mirroring the layout of the subtree.
+// Every file is written atomically, with the mode & ownership specified in the given options.
+// It returns true if any file has been written.
+func (c *AuthenticatedVaultClient) CreateSecretDirectory(dir string, secret DirSecret, options FileOptions) (bool, error) {
+	changed, err := NewSecretDirectoryTarget(dir, secret, options).Update(c)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	return changed, nil
+}
+
+// NewSecretDirectoryTarget creates a WatchTarget that keeps a directory containing
+// a file per secret (field) in a subtree up to date.
+func NewSecretDirectoryTarget(dir string, secret DirSecret, options FileOptions) WatchTarget {
+	return &secretDirTarget{dir: dir, secret: secret, options: options}
+}
+
+type secretDirTarget struct {
+	dir     string
+	secret  DirSecret
+	options FileOptions
+}
+
+// Update extracts the secrets and rewrites all files whose content has changed.
+func (t *secretDirTarget) Update(c *AuthenticatedVaultClient) (bool, error) {
+	files, err := c.secretDirectoryContent(t.secret)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	changed, err := writeDirectoryFiles(t.dir, files, t.options, defaultSecretFileMode)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	return changed, nil
+}
+
+// String returns a human readable description of the target.
+func (t *secretDirTarget) String() string {
+	return t.dir
+}
+
+// secretDirectoryContent extracts all secrets in a subtree and returns the content of all files
+// to create, keyed by their path relative to the target directory.
+func (c *AuthenticatedVaultClient) secretDirectoryContent(secret DirSecret) (map[string][]byte, error) {
+	root := strings.Trim(secret.SecretPath, "/")
+	if root == "" {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "path not set"))
+	}
+	if _, version := splitSecretVersion(root); version != 0 {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot pin a version of %s, versions are only supported for single secrets", secret.SecretPath))
+	}
+	secretPaths, err := c.listSecrets(root)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if len(secretPaths) == 0 {
+		return nil, maskAny(errgo.WithCausef(nil, SecretNotFoundError, "no secrets found under %s", secret.SecretPath))
+	}
+
+	files := make(map[string][]byte)
+	for _, secretPath := range secretPaths {
+		relPath := strings.TrimPrefix(secretPath, root+"/")
+		var fields map[string]string
+		op := func() error {
+			var err error
+			fields, err = c.extractSecretFields(secretPath)
+			if err != nil {
+				return maskAny(err)
+			}
+			return nil
+		}
+		if err := retry.Do(op, retry.RetryChecker(IsVault), retry.MaxTries(3)); err != nil {
+			return nil, maskAny(err)
+		}
+		if secret.SecretField != "" {
+			value, ok := fields[secret.SecretField]
+			if !ok {
+				return nil, maskAny(errgo.WithCausef(nil, SecretNotFoundError, "no field '%s' found at %s", secret.SecretField, secretPath))
+			}
+			files[relPath] = []byte(value)
+		} else {
+			for field, value := range fields {
+				if !isSafeFileName(field) {
+					return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "field '%s' at %s cannot be used as a file name", field, secretPath))
+				}
+				files[path.Join(relPath, field)] = []byte(value)
+			}
+		}
+	}
+	return files, nil
+}
+
+// listSecrets returns the paths of all secrets in the subtree with given root.
+func (c *AuthenticatedVaultClient) listSecrets(root string) ([]string, error) {
+	c.log.Infof("List %s", root)
+	var list []interface{}
+	op := func() error {
+		secret, err := c.kv.list(root)
+		if err != nil {
+			return maskAny(errgo.WithCausef(nil, VaultError, "error listing %s: %s", root, err))
+		}
+		list = nil
+		if secret != nil && secret.Data != nil {
+			list, _ = secret.Data["keys"].([]interface{})
+		}
+		return nil
+	}
+	if err := retry.Do(op, retry.RetryChecker(IsVault), retry.MaxTries(3)); err != nil {
+		return nil, maskAny(err)
+	}
+
+	result := []string{}
+	for _, raw := range list {
+		key, ok := raw.(string)
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(key, "/") {
+			// Sub directory
+			name := strings.TrimSuffix(key, "/")
+			if !isSafeFileName(name) {
+				return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "key '%s' under %s cannot be used as a directory name", key, root))
+			}
+			children, err := c.listSecrets(root + "/" + name)
+			if err != nil {
+				return nil, maskAny(err)
+			}
+			result = append(result, children...)
+		} else {
+			if !isSafeFileName(key) {
+				return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "key '%s' under %s cannot be used as a file name", key, root))
+			}
+			result = append(result, root+"/"+key)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// writeDirectoryFiles writes all given files (keyed by relative path) into the given directory.
+// Only files whose content has changed are written.
+// It returns true if at least one file has been written.
+func writeDirectoryFiles(dir string, files map[string][]byte, options FileOptions, defaultMode os.FileMode) (bool, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	changed := false
+	for _, name := range names {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		written, err := writeFileIfChanged(filePath, files[name], options, defaultMode)
+		if err != nil {
+			return changed, maskAny(err)
+		}
+		changed = changed || written
+	}
+	return changed, nil
+}
+
+// isSafeFileName returns true if the given name can be used as a single element of a file path.
+func isSafeFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
@@ -15,56 +15,251 @@
 package service
 
 import (
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"path"
+	"sort"
 	"strings"
 
 	"github.com/giantswarm/retry-go"
+	"github.com/juju/errgo"
+)
+
+const (
+	// WildcardField is the secret field that selects all fields of a secret.
+	WildcardField = "*"
+	// wildcardKey is the part of an environment key that is replaced by a field name.
+	wildcardKey = "*"
 )
 
 type EnvSecret struct {
-	SecretPath     string
-	SecretField    string
+	SecretPath  string
+	SecretField string // Use WildcardField to extract all fields of the secret
+	// EnvironmentKey must contain a '*' when SecretField is WildcardField.
+	// That '*' is replaced by the name of each field, sanitized for environment files & processes.
 	EnvironmentKey string
+	Include        []string // If set, only fields matching one of these patterns are extracted with WildcardField
+	Exclude        []string // Fields matching one of these patterns are not extracted with WildcardField
+}
+
+// IsWildcard returns true if this secret extracts all fields of a secret.
+func (s EnvSecret) IsWildcard() bool {
+	return s.SecretField == WildcardField
+}
+
+// Validate checks the secret for errors.
+func (s EnvSecret) Validate() error {
+	hasWildcardKey := strings.Count(s.EnvironmentKey, wildcardKey) == 1
+	if s.IsWildcard() && !hasWildcardKey {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "key '%s' must contain exactly one '*' to extract all fields of %s", s.EnvironmentKey, s.SecretPath))
+	}
+	if !s.IsWildcard() && strings.Contains(s.EnvironmentKey, wildcardKey) {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "key '%s' can only contain a '*' when extracting all fields (#*)", s.EnvironmentKey))
+	}
+	for _, pattern := range append(append([]string{}, s.Include...), s.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid field pattern '%s'", pattern))
+		}
+	}
+	return nil
+}
+
+// includesField returns true if the given field is selected by the include & exclude patterns.
+func (s EnvSecret) includesField(field string) bool {
+	if len(s.Include) > 0 && !matchesAny(s.Include, field) {
+		return false
+	}
+	return !matchesAny(s.Exclude, field)
+}
+
+// matchesAny returns true if the given name matches one of the given patterns.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if match, _ := path.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+// SanitizeEnvKey converts the given name into a valid environment variable name
+// by upper-casing it and replacing all invalid characters with an underscore.
+func SanitizeEnvKey(name string) string {
+	runes := []rune(strings.ToUpper(name))
+	for i, r := range runes {
+		if !((r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_') {
+			runes[i] = '_'
+		}
+	}
+	return string(runes)
+}
+
+// CreateEnvironmentFile extracts one or more secrets and creates an environment file
+// for them, formatted in the given format (nil results in the default format).
+// The file is written atomically, with the mode & ownership specified in the given options.
+// It returns true if the file has been written, false if it already had the same content.
+func (c *AuthenticatedVaultClient) CreateEnvironmentFile(path string, secrets []EnvSecret, format EnvFormat, options FileOptions) (bool, error) {
+	changed, err := NewEnvironmentFileTarget(path, secrets, format, options).Update(c)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	return changed, nil
+}
+
+// NewEnvironmentFileTarget creates a WatchTarget that keeps an environment file
+// containing the given secrets, formatted in the given format, up to date.
+func NewEnvironmentFileTarget(path string, secrets []EnvSecret, format EnvFormat, options FileOptions) WatchTarget {
+	return &envFileTarget{path: path, secrets: secrets, format: format, options: options}
+}
+
+type envFileTarget struct {
+	path    string
+	secrets []EnvSecret
+	format  EnvFormat
+	options FileOptions
+}
+
+// Update extracts the secrets and rewrites the environment file when its content has changed.
+func (t *envFileTarget) Update(c *AuthenticatedVaultClient) (bool, error) {
+	content, err := c.environmentFileContent(t.secrets, t.format)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	changed, err := writeFileIfChanged(t.path, content, t.options, defaultSecretFileMode)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	return changed, nil
+}
+
+// String returns a human readable description of the target.
+func (t *envFileTarget) String() string {
+	return t.path
+}
+
+// environmentFileContent extracts one or more secrets and returns
+// the content of an environment file for them, formatted in the given format.
+func (c *AuthenticatedVaultClient) environmentFileContent(secrets []EnvSecret, format EnvFormat) ([]byte, error) {
+	vars, err := c.extractEnvSecrets(secrets)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	content, err := formatEnvVars(vars, format)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return content, nil
+}
+
+// formatEnvVars returns the content of an environment file containing the given variables,
+// formatted in the given format (nil results in the default format).
+func formatEnvVars(vars []EnvVar, format EnvFormat) ([]byte, error) {
+	if format == nil {
+		var err error
+		if format, err = GetEnvFormat(DefaultEnvFormatName); err != nil {
+			return nil, maskAny(err)
+		}
+	}
+	content, err := format.Format(vars)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return content, nil
 }
 
-// CreateEnvironmentFile extracts one or more secrets and creates a key=secretValue
-// environment file for them.
-func (c *AuthenticatedVaultClient) CreateEnvironmentFile(path string, secrets []EnvSecret) error {
-	if err := ensureDirectoryOf(path, 0755); err != nil {
-		return maskAny(err)
+// extractEnvSecrets extracts one or more secrets and returns their keys & values.
+// Wildcard secrets are expanded into a key & value for every (selected) field,
+// using the sanitized name of the field, so the keys are valid environment variable names.
+func (c *AuthenticatedVaultClient) extractEnvSecrets(secrets []EnvSecret) ([]EnvVar, error) {
+	vars, err := c.extractSecretVars(secrets, SanitizeEnvKey)
+	if err != nil {
+		return nil, maskAny(err)
 	}
-	lines := []string{}
+	return vars, nil
+}
+
+// extractSecretVars extracts one or more secrets and returns their keys & values.
+// Wildcard secrets are expanded into a key & value for every (selected) field,
+// using the given function to convert the name of the field into (part of) a key.
+// Extracting different secret fields into the same key results in an InvalidArgumentError.
+func (c *AuthenticatedVaultClient) extractSecretVars(secrets []EnvSecret, fieldKey func(name string) string) ([]EnvVar, error) {
+	vars := newSecretVars()
 	for _, envSec := range secrets {
-		var value string
-		op := func() error {
-			var err error
-			value, err = c.extractSecret(envSec.SecretPath, envSec.SecretField)
-			if err != nil {
-				return maskAny(err)
-			}
-			return nil
+		if err := envSec.Validate(); err != nil {
+			return nil, maskAny(err)
 		}
-		if err := retry.Do(op, retry.RetryChecker(IsVault), retry.MaxTries(3)); err != nil {
-			return maskAny(err)
+		if envSec.IsWildcard() {
+			var fields map[string]string
+			op := func() error {
+				var err error
+				fields, err = c.extractSecretFields(envSec.SecretPath)
+				if err != nil {
+					return maskAny(err)
+				}
+				return nil
+			}
+			if err := retry.Do(op, retry.RetryChecker(IsVault), retry.MaxTries(3)); err != nil {
+				return nil, maskAny(err)
+			}
+			if err := vars.addFields(envSec, fields, fieldKey); err != nil {
+				return nil, maskAny(err)
+			}
+		} else {
+			var value string
+			op := func() error {
+				var err error
+				value, err = c.extractSecret(envSec.SecretPath, envSec.SecretField)
+				if err != nil {
+					return maskAny(err)
+				}
+				return nil
+			}
+			if err := retry.Do(op, retry.RetryChecker(IsVault), retry.MaxTries(3)); err != nil {
+				return nil, maskAny(err)
+			}
+			if err := vars.add(envSec.EnvironmentKey, value, envSec.SecretPath, envSec.SecretField); err != nil {
+				return nil, maskAny(err)
+			}
 		}
-		line := fmt.Sprintf("%s=%s", envSec.EnvironmentKey, value)
-		lines = append(lines, line)
 	}
-	content := strings.Join(lines, "\n")
-	if err := ioutil.WriteFile(path, []byte(content), 0400); err != nil {
-		return maskAny(err)
+	return vars.vars, nil
+}
+
+// secretVars collects the keys & values of extracted secrets.
+type secretVars struct {
+	vars    []EnvVar
+	sources map[string]string // Secret field (path#field) that each key is extracted from
+}
+
+func newSecretVars() *secretVars {
+	return &secretVars{vars: []EnvVar{}, sources: make(map[string]string)}
+}
+
+// add adds the given key & value, extracted from the given field of the secret at the given path.
+// It returns an InvalidArgumentError if the key has already been extracted from another field.
+func (v *secretVars) add(key, value, path, field string) error {
+	source := path + "#" + field
+	if existing, found := v.sources[key]; found {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "key '%s' is extracted from both %s and %s", key, existing, source))
 	}
+	v.sources[key] = source
+	v.vars = append(v.vars, EnvVar{Key: key, Value: value})
 	return nil
 }
 
-// ensureDirectoryOf creates the directory part of the given file path if needed.
-func ensureDirectoryOf(path string, perm os.FileMode) error {
-	dir := filepath.Dir(path)
-	if err := os.MkdirAll(dir, perm); err != nil {
-		return maskAny(err)
+// addFields adds a key & value for every field (selected by the given wildcard secret) of the given fields,
+// sorted by field name.
+func (v *secretVars) addFields(secret EnvSecret, fields map[string]string, fieldKey func(name string) string) error {
+	names := []string{}
+	for name := range fields {
+		if secret.includesField(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		key := strings.Replace(secret.EnvironmentKey, wildcardKey, fieldKey(name), 1)
+		if err := v.add(key, fields[name], secret.SecretPath, name); err != nil {
+			return maskAny(err)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,88 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/juju/errgo"
+)
+
+func TestSecretVarsAddFields(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Secrets   []EnvSecret
+		Fields    map[string]string // Fields of every secret
+		FieldKey  func(name string) string
+		Expected  []EnvVar
+		ExpectErr bool
+	}{
+		{
+			Name:     "sanitized keys",
+			Secrets:  []EnvSecret{{SecretPath: "/secret/db", SecretField: WildcardField, EnvironmentKey: "DB_*"}},
+			Fields:   map[string]string{"host": "h", "user-name": "u"},
+			FieldKey: SanitizeEnvKey,
+			Expected: []EnvVar{{Key: "DB_HOST", Value: "h"}, {Key: "DB_USER_NAME", Value: "u"}},
+		},
+		{
+			Name:      "sanitized keys collide",
+			Secrets:   []EnvSecret{{SecretPath: "/secret/db", SecretField: WildcardField, EnvironmentKey: "*"}},
+			Fields:    map[string]string{"db-host": "a", "db_host": "b"},
+			FieldKey:  SanitizeEnvKey,
+			ExpectErr: true,
+		},
+		{
+			Name:     "unsanitized keys",
+			Secrets:  []EnvSecret{{SecretPath: "/secret/db", SecretField: WildcardField, EnvironmentKey: "*"}},
+			Fields:   map[string]string{"db-host": "a", "db_host": "b"},
+			FieldKey: func(name string) string { return name },
+			Expected: []EnvVar{{Key: "db-host", Value: "a"}, {Key: "db_host", Value: "b"}},
+		},
+		{
+			Name: "keys of different secrets collide",
+			Secrets: []EnvSecret{
+				{SecretPath: "/secret/db1", SecretField: WildcardField, EnvironmentKey: "DB_*"},
+				{SecretPath: "/secret/db2", SecretField: WildcardField, EnvironmentKey: "DB_*"},
+			},
+			Fields:    map[string]string{"host": "h"},
+			FieldKey:  SanitizeEnvKey,
+			ExpectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		vars := newSecretVars()
+		var err error
+		for _, s := range test.Secrets {
+			if err = vars.addFields(s, test.Fields, test.FieldKey); err != nil {
+				break
+			}
+		}
+		if test.ExpectErr {
+			if errgo.Cause(err) != InvalidArgumentError {
+				t.Errorf("Test '%s': expected InvalidArgumentError, got %v", test.Name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test '%s': unexpected error: %s", test.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(vars.vars, test.Expected) {
+			t.Errorf("Test '%s': expected %v, got %v", test.Name, test.Expected, vars.vars)
+		}
+	}
+}
@@ -15,8 +15,6 @@
 package service
 
 import (
-	"io/ioutil"
-
 	"github.com/giantswarm/retry-go"
 )
 
@@ -27,10 +25,48 @@ type FileSecret struct {
 
 // CreateSecretFile extracts one secret and creates a file containing
 // the secret value.
-func (c *AuthenticatedVaultClient) CreateSecretFile(path string, secret FileSecret) error {
-	if err := ensureDirectoryOf(path, 0755); err != nil {
-		return maskAny(err)
+// The file is written atomically, with the mode & ownership specified in the given options.
+// It returns true if the file has been written, false if it already had the same content.
+func (c *AuthenticatedVaultClient) CreateSecretFile(path string, secret FileSecret, options FileOptions) (bool, error) {
+	changed, err := NewSecretFileTarget(path, secret, options).Update(c)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	return changed, nil
+}
+
+// NewSecretFileTarget creates a WatchTarget that keeps a file containing
+// the value of the given secret up to date.
+func NewSecretFileTarget(path string, secret FileSecret, options FileOptions) WatchTarget {
+	return &secretFileTarget{path: path, secret: secret, options: options}
+}
+
+type secretFileTarget struct {
+	path    string
+	secret  FileSecret
+	options FileOptions
+}
+
+// Update extracts the secret and rewrites the file when its content has changed.
+func (t *secretFileTarget) Update(c *AuthenticatedVaultClient) (bool, error) {
+	value, err := c.secretFileContent(t.secret)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	changed, err := writeFileIfChanged(t.path, value, t.options, defaultSecretFileMode)
+	if err != nil {
+		return false, maskAny(err)
 	}
+	return changed, nil
+}
+
+// String returns a human readable description of the target.
+func (t *secretFileTarget) String() string {
+	return t.path
+}
+
+// secretFileContent extracts one secret and returns its value.
+func (c *AuthenticatedVaultClient) secretFileContent(secret FileSecret) ([]byte, error) {
 	var value string
 	op := func() error {
 		var err error
@@ -41,10 +77,7 @@ func (c *AuthenticatedVaultClient) CreateSecretFile(path string, secret FileSecr
 		return nil
 	}
 	if err := retry.Do(op, retry.RetryChecker(IsVault), retry.MaxTries(3)); err != nil {
-		return maskAny(err)
-	}
-	if err := ioutil.WriteFile(path, []byte(value), 0400); err != nil {
-		return maskAny(err)
+		return nil, maskAny(err)
 	}
-	return nil
+	return []byte(value), nil
 }
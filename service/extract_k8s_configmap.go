@@ -0,0 +1,164 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"reflect"
+	"time"
+	"unicode/utf8"
+
+	k8s "github.com/YakLabs/k8s-client"
+	"github.com/giantswarm/retry-go"
+	"github.com/juju/errgo"
+)
+
+// CreateOrUpdateKubernetesConfigMap extracts one or more secrets and updates fields in a Kubernetes config map.
+// Use this only for values that are not sensitive (e.g. CA bundles), since config maps are not protected like secrets.
+// The config map is not written when it already contains the extracted values.
+// It returns true if the config map has been written.
+func (c *AuthenticatedVaultClient) CreateOrUpdateKubernetesConfigMap(client *K8sClient, configMapName string, secrets ...EnvSecret) (bool, error) {
+	if client == nil {
+		return false, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "not running in kubernetes"))
+	}
+
+	// Fetch secrets
+	vars, err := c.extractKubernetesSecrets(secrets)
+	if err != nil {
+		return false, maskAny(err)
+	}
+
+	// Create/update config map
+	changed, err := client.storeKubernetesConfigMapData(configMapName, vars, envSecretPaths(secrets))
+	if err != nil {
+		return false, maskAny(err)
+	}
+	if changed {
+		c.log.Infof("Updated kubernetes config map %s", configMapName)
+	} else {
+		c.log.Infof("Kubernetes config map %s is up to date", configMapName)
+	}
+	return changed, nil
+}
+
+// kubernetesConfigMap is a Kubernetes config map.
+// The k8s-client does not support string data & binary data of config maps, so this type is used instead.
+type kubernetesConfigMap struct {
+	k8s.TypeMeta
+	Metadata   kubernetesObjectMeta `json:"metadata,omitempty"`
+	Data       map[string]string    `json:"data,omitempty"`
+	BinaryData map[string][]byte    `json:"binaryData,omitempty"`
+}
+
+// configMapPath returns the API path of the Kubernetes config map with given name.
+func (client *K8sClient) configMapPath(configMapName string) string {
+	return k8sCoreAPIPathPrefix + client.namespace + "/configmaps/" + configMapName
+}
+
+// storeKubernetesConfigMapData sets the given key/value pairs in the Kubernetes config map with given name.
+// The config map is created if it does not exist yet.
+// Values that are not valid UTF-8 are stored as binary data.
+// The config map is not written when it already contains the given data.
+// Conflicting writes (e.g. by another replica) are retried.
+// The keys that did not exist in the config map before are recorded as added by this process,
+// so they can be removed by CleanupWrittenTargets (or Cleanup).
+// It returns true if the config map has been written.
+func (client *K8sClient) storeKubernetesConfigMapData(configMapName string, vars []EnvVar, sourcePaths []string) (bool, error) {
+	changed := false
+	var addedKeys []string
+	op := func() error {
+		// Get existing config map or initialize new one
+		create := false
+		var configMap kubernetesConfigMap
+		err := client.conn.do("GET", client.configMapPath(configMapName), "", nil, &configMap)
+		if isKubernetesNotFound(err) {
+			create = true
+			configMap = kubernetesConfigMap{
+				TypeMeta: k8s.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+				Metadata: kubernetesObjectMeta{
+					ObjectMeta: k8s.ObjectMeta{
+						Name:      configMapName,
+						Namespace: client.namespace,
+					},
+				},
+			}
+		} else if err != nil {
+			return maskAny(errgo.WithCausef(nil, KubernetesError, "cannot get kubernetes config map %s: %s", configMapName, err))
+		}
+
+		// Update data & metadata
+		updated := applyKubernetesConfigMapData(configMap, vars, sourcePaths)
+		if !create && reflect.DeepEqual(updated, configMap) {
+			changed = false
+			return nil
+		}
+		updated.Metadata.Annotations[k8sExtractedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
+		// Create/update config map
+		addedKeys = nil
+		for _, v := range vars {
+			_, inData := configMap.Data[v.Key]
+			_, inBinaryData := configMap.BinaryData[v.Key]
+			if !inData && !inBinaryData {
+				addedKeys = append(addedKeys, v.Key)
+			}
+		}
+		updated.Kind, updated.APIVersion = "ConfigMap", "v1"
+		if create {
+			err = client.conn.do("POST", k8sCoreAPIPathPrefix+client.namespace+"/configmaps", k8sJSONContentType, updated, nil)
+		} else {
+			err = client.conn.do("PUT", client.configMapPath(configMapName), k8sJSONContentType, updated, nil)
+		}
+		if err != nil {
+			return maskAny(err)
+		}
+		changed = true
+		return nil
+	}
+	if err := retry.Do(op, retry.RetryChecker(isKubernetesConflict), retry.MaxTries(k8sConflictMaxTries), retry.Sleep(k8sConflictRetryDelay)); err != nil {
+		return false, maskAny(err)
+	}
+	if changed {
+		recordKubernetesConfigMapKeys(client.namespace, configMapName, addedKeys)
+	}
+	return changed, nil
+}
+
+// applyKubernetesConfigMapData returns a copy of the given config map with the given data & metadata set.
+// The extraction time annotation is left untouched.
+func applyKubernetesConfigMapData(configMap kubernetesConfigMap, vars []EnvVar, sourcePaths []string) kubernetesConfigMap {
+	result := configMap
+	result.Data = make(map[string]string)
+	for k, v := range configMap.Data {
+		result.Data[k] = v
+	}
+	result.BinaryData = make(map[string][]byte)
+	for k, v := range configMap.BinaryData {
+		result.BinaryData[k] = v
+	}
+	for _, v := range vars {
+		if utf8.ValidString(v.Value) {
+			result.Data[v.Key] = v.Value
+			delete(result.BinaryData, v.Key)
+		} else {
+			result.BinaryData[v.Key] = []byte(v.Value)
+			delete(result.Data, v.Key)
+		}
+	}
+	if len(result.BinaryData) == 0 && configMap.BinaryData == nil {
+		result.BinaryData = nil
+	}
+	result.Metadata.ObjectMeta = applyKubernetesMetadata(configMap.Metadata.ObjectMeta, nil, nil, sourcePaths)
+	return result
+}
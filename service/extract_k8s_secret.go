@@ -15,52 +15,460 @@
 package service
 
 import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
 	k8s "github.com/YakLabs/k8s-client"
-	retry "github.com/pulcy/vault-monkey/deps/github.com/giantswarm/retry-go"
+	"github.com/giantswarm/retry-go"
+	"github.com/juju/errgo"
+	"github.com/pkg/errors"
 )
 
+const (
+	// KubernetesOwnerPod makes the pod vault-monkey is running in the owner of a Kubernetes secret.
+	KubernetesOwnerPod = "pod"
+	// KubernetesOwnerDeployment makes the deployment of the pod vault-monkey is running in the owner of a Kubernetes secret.
+	KubernetesOwnerDeployment = "deployment"
+
+	k8sManagedByLabel         = "app.kubernetes.io/managed-by"
+	k8sManagedByValue         = "vault-monkey"
+	k8sSourcePathsAnnotation  = "vault-monkey.pulcy.com/source-paths"
+	k8sExtractedAtAnnotation  = "vault-monkey.pulcy.com/extracted-at"
+	k8sSecretTypeOpaque       = "Opaque"
+	k8sSecretTypeTLS          = "kubernetes.io/tls"
+	k8sSecretTypeDockerConfig = "kubernetes.io/dockerconfigjson"
+	k8sSecretTypeBasicAuth    = "kubernetes.io/basic-auth"
+	k8sReplicaSetKind         = "ReplicaSet"
+	k8sDeploymentKind         = "Deployment"
+	k8sPodKind                = "Pod"
+	k8sPodAPIVersion          = "v1"
+	k8sNotFoundStatusCode     = 404
+	k8sConflictStatusCode     = 409
+	k8sConflictMaxTries       = 5
+	k8sConflictRetryDelay     = time.Millisecond * 200
+)
+
+var (
+	// k8sKeyPattern matches valid keys of Kubernetes secrets & config maps.
+	k8sKeyPattern = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+	// k8sSecretTypeKeys contains the supported secret types with the keys they require.
+	k8sSecretTypeKeys = map[string][]string{
+		k8sSecretTypeOpaque:       nil,
+		k8sSecretTypeTLS:          []string{"tls.crt", "tls.key"},
+		k8sSecretTypeDockerConfig: []string{".dockerconfigjson"},
+		k8sSecretTypeBasicAuth:    []string{"username", "password"},
+	}
+)
+
+// KubernetesSecretOptions holds the settings of a Kubernetes secret target.
+type KubernetesSecretOptions struct {
+	Type        string            // Type of the secret (defaults to Opaque)
+	Labels      map[string]string // Labels added to the secret
+	Annotations map[string]string // Annotations added to the secret
+	Owner       string            // If set, the secret is owned by (and garbage collected with) this object (KubernetesOwnerPod|KubernetesOwnerDeployment)
+}
+
+// Validate checks the options for errors.
+func (o KubernetesSecretOptions) Validate() error {
+	if _, ok := k8sSecretTypeKeys[o.secretType()]; !ok {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unsupported kubernetes secret type '%s'", o.Type))
+	}
+	switch o.Owner {
+	case "", KubernetesOwnerPod, KubernetesOwnerDeployment:
+	default:
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unsupported kubernetes secret owner '%s', expected %s or %s", o.Owner, KubernetesOwnerPod, KubernetesOwnerDeployment))
+	}
+	return nil
+}
+
+// secretType returns the type of the secret.
+func (o KubernetesSecretOptions) secretType() string {
+	if o.Type == "" {
+		return k8sSecretTypeOpaque
+	}
+	return o.Type
+}
+
 // CreateOrUpdateKubernetesSecret extracts one or more secrets and updates fields in a Kubernetes secret.
-func (c *AuthenticatedVaultClient) CreateOrUpdateKubernetesSecret(client *K8sClient, secretName string, secrets ...EnvSecret) error {
-	namespace, err := getKubernetesNamespace()
+// The Kubernetes secret is not written when it already contains the extracted values.
+// It returns true if the Kubernetes secret has been written.
+func (c *AuthenticatedVaultClient) CreateOrUpdateKubernetesSecret(client *K8sClient, secretName string, options KubernetesSecretOptions, secrets ...EnvSecret) (bool, error) {
+	if err := options.Validate(); err != nil {
+		return false, maskAny(err)
+	}
+
+	if client == nil {
+		return false, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "not running in kubernetes"))
+	}
+
+	// Fetch secrets
+	vars, err := c.extractKubernetesSecrets(secrets)
 	if err != nil {
-		return maskAny(err)
+		return false, maskAny(err)
 	}
 
-	// Get existing secret or initialize new one
-	create := false
-	secret, err := client.getKubernetesSecret(secretName)
+	// Create/update secret
+	changed, err := client.storeKubernetesSecretData(secretName, vars, options, envSecretPaths(secrets))
 	if err != nil {
-		create = true
-		secret.ObjectMeta = k8s.ObjectMeta{
-			Name:      secretName,
-			Namespace: namespace,
+		return false, maskAny(err)
+	}
+	if changed {
+		c.log.Infof("Updated kubernetes secret %s", secretName)
+	} else {
+		c.log.Infof("Kubernetes secret %s is up to date", secretName)
+	}
+
+	return changed, nil
+}
+
+// extractKubernetesSecrets extracts one or more secrets and returns their keys & values for use in a
+// Kubernetes secret or config map.
+// Wildcard secrets are expanded into a key & value for every (selected) field, using the name of the field as is
+// (e.g. tls.crt). All keys must be valid Kubernetes keys.
+func (c *AuthenticatedVaultClient) extractKubernetesSecrets(secrets []EnvSecret) ([]EnvVar, error) {
+	vars, err := c.extractSecretVars(secrets, func(name string) string { return name })
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	for _, v := range vars {
+		if !k8sKeyPattern.MatchString(v.Key) {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "'%s' is not a valid kubernetes key (allowed are letters, digits, '-', '_' and '.')", v.Key))
 		}
 	}
-	if secret.Data == nil {
-		secret.Data = make(map[string][]byte)
+	return vars, nil
+}
+
+// envSecretPaths returns the sorted, unique paths of the given secrets.
+func envSecretPaths(secrets []EnvSecret) []string {
+	found := make(map[string]struct{})
+	result := []string{}
+	for _, s := range secrets {
+		if _, ok := found[s.SecretPath]; !ok {
+			found[s.SecretPath] = struct{}{}
+			result = append(result, s.SecretPath)
+		}
 	}
+	sort.Strings(result)
+	return result
+}
 
-	// Fetch secrets
-	for _, envSec := range secrets {
-		var value string
-		op := func() error {
-			var err error
-			value, err = c.extractSecret(envSec.SecretPath, envSec.SecretField)
+// storeKubernetesSecretData sets the given key/value pairs in the Kubernetes secret with given name.
+// The secret is created if it does not exist yet.
+// The given source paths are recorded in an annotation of the secret.
+// The secret is not written when it already contains the given data (and metadata).
+// Conflicting writes (e.g. by another replica) are retried.
+// The keys that did not exist in the secret before are recorded as added by this process,
+// so they can be removed by CleanupWrittenTargets (or Cleanup).
+// It returns true if the secret has been written.
+func (client *K8sClient) storeKubernetesSecretData(secretName string, vars []EnvVar, options KubernetesSecretOptions, sourcePaths []string) (bool, error) {
+	changed, addedKeys, err := client.writeKubernetesSecretData(secretName, vars, options, sourcePaths)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	if changed {
+		recordKubernetesSecretKeys(client.namespace, secretName, addedKeys)
+	}
+	return changed, nil
+}
+
+// writeKubernetesSecretData is storeKubernetesSecretData without recording the added keys.
+// It returns true if the secret has been written and the keys that did not exist in the secret before.
+func (client *K8sClient) writeKubernetesSecretData(secretName string, vars []EnvVar, options KubernetesSecretOptions, sourcePaths []string) (bool, []string, error) {
+	var owner *kubernetesOwnerReference
+	if options.Owner != "" {
+		ref, err := client.ownerReference(options.Owner)
+		if err != nil {
+			return false, nil, maskAny(err)
+		}
+		owner = &ref
+	}
+
+	changed := false
+	var addedKeys []string
+	op := func() error {
+		// Get existing secret or initialize new one & update data & metadata
+		secret, updated, create, err := client.prepareKubernetesSecret(secretName, vars, options, sourcePaths)
+		if err != nil {
+			return maskAny(err)
+		}
+		dataChanged := create || !reflect.DeepEqual(updated, secret)
+
+		// Owner references are not supported by the k8s-client, so they are read & patched separately
+		path := client.secretPath(secretName)
+		var owners []kubernetesOwnerReference
+		if !create && (dataChanged || owner != nil) {
+			existing, err := client.getObjectOwners(path)
 			if err != nil {
-				return maskAny(err)
+				return maskAny(errgo.WithCausef(nil, KubernetesError, "cannot get owners of kubernetes secret %s: %s", secretName, err))
 			}
+			owners = existing.Metadata.OwnerReferences
+		}
+		wantedOwners := owners
+		if owner != nil {
+			wantedOwners = addOwnerReference(owners, *owner)
+		}
+		if !dataChanged && len(wantedOwners) == len(owners) {
+			// Nothing changed, avoid triggering watchers (e.g. rollouts)
+			changed = false
 			return nil
 		}
-		if err := retry.Do(op, retry.RetryChecker(IsVault), retry.MaxTries(3)); err != nil {
-			return maskAny(err)
+
+		// Create/update secret
+		addedKeys = newKeys(secret.Data, vars)
+		if dataChanged {
+			updated.Annotations[k8sExtractedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+			if err := client.setKubernetesSecret(secretName, updated, create); err != nil {
+				return maskAny(err)
+			}
+		}
+		if len(wantedOwners) > 0 {
+			// Updating the secret through the k8s-client drops its owner references, so (re)set them
+			if err := client.patchOwnerReferences(path, wantedOwners); err != nil {
+				return maskAny(errgo.WithCausef(nil, KubernetesError, "cannot set owners of kubernetes secret %s: %s", secretName, err))
+			}
 		}
-		secret.Data[envSec.EnvironmentKey] = []byte(value)
+		changed = true
+		return nil
 	}
+	if err := retry.Do(op, retry.RetryChecker(isKubernetesConflict), retry.MaxTries(k8sConflictMaxTries), retry.Sleep(k8sConflictRetryDelay)); err != nil {
+		return false, nil, maskAny(err)
+	}
+	if !changed {
+		return false, nil, nil
+	}
+	return true, addedKeys, nil
+}
 
-	// Create/update secret
-	if err := client.setKubernetesSecret(secretName, secret, create); err != nil {
+// checkKubernetesSecretData checks that the given key/value pairs can be stored in the Kubernetes secret
+// with given name, without writing anything.
+func (client *K8sClient) checkKubernetesSecretData(secretName string, vars []EnvVar, options KubernetesSecretOptions, sourcePaths []string) error {
+	if options.Owner != "" {
+		if _, err := client.ownerReference(options.Owner); err != nil {
+			return maskAny(err)
+		}
+	}
+	if _, _, _, err := client.prepareKubernetesSecret(secretName, vars, options, sourcePaths); err != nil {
 		return maskAny(err)
 	}
+	return nil
+}
+
+// prepareKubernetesSecret fetches the Kubernetes secret with given name (or initializes a new one) and
+// applies the given key/value pairs & options to it.
+// It returns the existing secret, the updated secret and true if the secret does not exist yet.
+func (client *K8sClient) prepareKubernetesSecret(secretName string, vars []EnvVar, options KubernetesSecretOptions, sourcePaths []string) (k8s.Secret, k8s.Secret, bool, error) {
+	create := false
+	secret, err := client.getKubernetesSecret(secretName)
+	if isKubernetesNotFound(err) {
+		create = true
+		secret = k8s.Secret{
+			ObjectMeta: k8s.ObjectMeta{
+				Name:      secretName,
+				Namespace: client.namespace,
+			},
+			Type: k8s.SecretType(options.secretType()),
+		}
+	} else if err != nil {
+		return k8s.Secret{}, k8s.Secret{}, false, maskAny(errgo.WithCausef(nil, KubernetesError, "cannot get kubernetes secret %s: %s", secretName, err))
+	} else if string(secret.Type) != options.secretType() {
+		// The type of a secret cannot be changed
+		return k8s.Secret{}, k8s.Secret{}, false, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "kubernetes secret %s has type '%s', expected '%s'", secretName, secret.Type, options.secretType()))
+	}
+
+	updated := applyKubernetesSecretData(secret, vars, options, sourcePaths)
+	for _, key := range k8sSecretTypeKeys[options.secretType()] {
+		if _, found := updated.Data[key]; !found {
+			return k8s.Secret{}, k8s.Secret{}, false, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "kubernetes secret %s of type '%s' requires key '%s'", secretName, options.secretType(), key))
+		}
+	}
+	return secret, updated, create, nil
+}
+
+// newKeys returns the keys of the given variables that do not exist in the given data.
+func newKeys(data map[string][]byte, vars []EnvVar) []string {
+	var result []string
+	for _, v := range vars {
+		if _, found := data[v.Key]; !found {
+			result = append(result, v.Key)
+		}
+	}
+	return result
+}
+
+// applyKubernetesSecretData returns a copy of the given secret with the given data & metadata set.
+// The extraction time annotation is left untouched.
+func applyKubernetesSecretData(secret k8s.Secret, vars []EnvVar, options KubernetesSecretOptions, sourcePaths []string) k8s.Secret {
+	result := secret
+	result.Data = make(map[string][]byte)
+	for k, v := range secret.Data {
+		result.Data[k] = v
+	}
+	for _, v := range vars {
+		result.Data[v.Key] = []byte(v.Value)
+	}
+	result.ObjectMeta = applyKubernetesMetadata(secret.ObjectMeta, options.Labels, options.Annotations, sourcePaths)
+	return result
+}
+
+// applyKubernetesMetadata returns a copy of the given metadata with the given labels & annotations added.
+// The managed-by label and source paths annotation are always set.
+func applyKubernetesMetadata(meta k8s.ObjectMeta, labels, annotations map[string]string, sourcePaths []string) k8s.ObjectMeta {
+	result := meta
+	result.Labels = make(map[string]string)
+	for k, v := range meta.Labels {
+		result.Labels[k] = v
+	}
+	for k, v := range labels {
+		result.Labels[k] = v
+	}
+	result.Labels[k8sManagedByLabel] = k8sManagedByValue
+	result.Annotations = make(map[string]string)
+	for k, v := range meta.Annotations {
+		result.Annotations[k] = v
+	}
+	for k, v := range annotations {
+		result.Annotations[k] = v
+	}
+	result.Annotations[k8sSourcePathsAnnotation] = strings.Join(sourcePaths, ",")
+	return result
+}
+
+// kubernetesOwnerReference identifies an object that owns a Kubernetes secret.
+type kubernetesOwnerReference struct {
+	APIVersion         string  `json:"apiVersion"`
+	Kind               string  `json:"kind"`
+	Name               string  `json:"name"`
+	UID                k8s.UID `json:"uid"`
+	Controller         *bool   `json:"controller,omitempty"`
+	BlockOwnerDeletion *bool   `json:"blockOwnerDeletion,omitempty"`
+}
+
+// kubernetesObjectMeta is the metadata of a Kubernetes object, including the owner references
+// that are not supported by the k8s-client.
+type kubernetesObjectMeta struct {
+	k8s.ObjectMeta
+	OwnerReferences []kubernetesOwnerReference `json:"ownerReferences,omitempty"`
+}
+
+// kubernetesObjectOwners is the part of a Kubernetes object that identifies it and its owners.
+type kubernetesObjectOwners struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string                     `json:"name"`
+		UID             k8s.UID                    `json:"uid"`
+		OwnerReferences []kubernetesOwnerReference `json:"ownerReferences,omitempty"`
+	} `json:"metadata"`
+}
+
+// secretPath returns the API path of the Kubernetes secret with given name.
+func (client *K8sClient) secretPath(secretName string) string {
+	return k8sCoreAPIPathPrefix + client.namespace + "/secrets/" + secretName
+}
 
+// getObjectOwners fetches the identity & owner references of the Kubernetes object at the given API path.
+func (client *K8sClient) getObjectOwners(path string) (kubernetesObjectOwners, error) {
+	var result kubernetesObjectOwners
+	if err := client.conn.do("GET", path, "", nil, &result); err != nil {
+		return kubernetesObjectOwners{}, maskAny(err)
+	}
+	return result, nil
+}
+
+// patchOwnerReferences adds the given owner references to the Kubernetes object at the given API path.
+// Existing owner references with a different UID are kept.
+func (client *K8sClient) patchOwnerReferences(path string, owners []kubernetesOwnerReference) error {
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": owners,
+		},
+	}
+	if err := client.conn.do("PATCH", path, k8sStrategicMergePatch, patch, nil); err != nil {
+		return maskAny(err)
+	}
 	return nil
 }
+
+// ownerReference returns a reference to the object of given kind (KubernetesOwnerPod|KubernetesOwnerDeployment)
+// that owns the pod this process is running in.
+func (client *K8sClient) ownerReference(kind string) (kubernetesOwnerReference, error) {
+	if client.podName == "" {
+		return kubernetesOwnerReference{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "kubernetes pod name not set"))
+	}
+	pod, err := client.getObjectOwners(k8sCoreAPIPathPrefix + client.namespace + "/pods/" + client.podName)
+	if err != nil {
+		return kubernetesOwnerReference{}, maskAny(errgo.WithCausef(nil, KubernetesError, "cannot get pod %s: %s", client.podName, err))
+	}
+	if kind == KubernetesOwnerPod {
+		return kubernetesOwnerReference{
+			APIVersion: k8sPodAPIVersion,
+			Kind:       k8sPodKind,
+			Name:       pod.Metadata.Name,
+			UID:        pod.Metadata.UID,
+		}, nil
+	}
+
+	// Find deployment through the replica set that controls the pod
+	rsRef, found := controllerOf(pod.Metadata.OwnerReferences, k8sReplicaSetKind)
+	if !found {
+		return kubernetesOwnerReference{}, maskAny(errgo.WithCausef(nil, KubernetesError, "pod %s is not controlled by a replica set", client.podName))
+	}
+	rs, err := client.getObjectOwners(k8sAppsAPIPathPrefix + client.namespace + "/replicasets/" + rsRef.Name)
+	if err != nil {
+		return kubernetesOwnerReference{}, maskAny(errgo.WithCausef(nil, KubernetesError, "cannot get replica set %s: %s", rsRef.Name, err))
+	}
+	deplRef, found := controllerOf(rs.Metadata.OwnerReferences, k8sDeploymentKind)
+	if !found {
+		return kubernetesOwnerReference{}, maskAny(errgo.WithCausef(nil, KubernetesError, "replica set %s is not controlled by a deployment", rsRef.Name))
+	}
+	return kubernetesOwnerReference{
+		APIVersion: deplRef.APIVersion,
+		Kind:       deplRef.Kind,
+		Name:       deplRef.Name,
+		UID:        deplRef.UID,
+	}, nil
+}
+
+// controllerOf returns the owner reference of given kind that controls an object.
+func controllerOf(refs []kubernetesOwnerReference, kind string) (kubernetesOwnerReference, bool) {
+	for _, ref := range refs {
+		if ref.Kind == kind && ref.Controller != nil && *ref.Controller {
+			return ref, true
+		}
+	}
+	return kubernetesOwnerReference{}, false
+}
+
+// addOwnerReference adds the given owner to the list of owner references, unless it is already there.
+func addOwnerReference(refs []kubernetesOwnerReference, owner kubernetesOwnerReference) []kubernetesOwnerReference {
+	for _, ref := range refs {
+		if ref.UID == owner.UID {
+			return refs
+		}
+	}
+	return append(append([]kubernetesOwnerReference{}, refs...), owner)
+}
+
+// kubernetesStatusCode returns the HTTP status code of the given Kubernetes API error (0 if unknown).
+func kubernetesStatusCode(err error) int32 {
+	if err == nil {
+		return 0
+	}
+	if status, ok := errors.Cause(errgo.Cause(err)).(*k8s.Status); ok {
+		return status.Code
+	}
+	return 0
+}
+
+// isKubernetesNotFound returns true if the given error is a Kubernetes NotFound error.
+func isKubernetesNotFound(err error) bool {
+	return kubernetesStatusCode(err) == k8sNotFoundStatusCode
+}
+
+// isKubernetesConflict returns true if the given error is a Kubernetes Conflict or AlreadyExists error.
+func isKubernetesConflict(err error) bool {
+	return kubernetesStatusCode(err) == k8sConflictStatusCode
+}
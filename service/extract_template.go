@@ -0,0 +1,203 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/giantswarm/retry-go"
+	"github.com/juju/errgo"
+)
+
+const (
+	defaultSecretField = "value"
+)
+
+// CreateTemplateFile renders the Go text template found at the given source path
+// and creates a file containing the result.
+// The template can use the following functions:
+// - secret "path" ["field"] returns the value of a secret field (field defaults to 'value').
+// - secretJSON "path" ["field"] returns the JSON decoded value of a secret field.
+// - base64Decode "value" returns the base64 decoded value.
+// - env "key" returns the value of an environment variable.
+// The file is written atomically, with the mode & ownership specified in the given options.
+// It returns true if the file has been written, false if it already had the same content.
+func (c *AuthenticatedVaultClient) CreateTemplateFile(path, sourcePath string, options FileOptions) (bool, error) {
+	changed, err := NewTemplateFileTarget(path, sourcePath, options).Update(c)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	return changed, nil
+}
+
+// NewTemplateFileTarget creates a WatchTarget that keeps a file containing
+// the rendered template found at the given source path up to date.
+func NewTemplateFileTarget(path, sourcePath string, options FileOptions) WatchTarget {
+	return &templateFileTarget{path: path, sourcePath: sourcePath, options: options}
+}
+
+type templateFileTarget struct {
+	path       string
+	sourcePath string
+	options    FileOptions
+}
+
+// Update renders the template and rewrites the file when its content has changed.
+func (t *templateFileTarget) Update(c *AuthenticatedVaultClient) (bool, error) {
+	content, err := c.templateFileContent(t.sourcePath)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	changed, err := writeFileIfChanged(t.path, content, t.options, defaultSecretFileMode)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	return changed, nil
+}
+
+// String returns a human readable description of the target.
+func (t *templateFileTarget) String() string {
+	return t.path
+}
+
+// templateFileContent renders the Go text template found at the given source path.
+func (c *AuthenticatedVaultClient) templateFileContent(sourcePath string) ([]byte, error) {
+	extract := func(secretPath, field string) (*string, error) {
+		var value string
+		op := func() error {
+			var err error
+			value, err = c.extractSecret(secretPath, field)
+			if err != nil {
+				return maskAny(err)
+			}
+			return nil
+		}
+		if err := retry.Do(op, retry.RetryChecker(IsVault), retry.MaxTries(3)); err != nil {
+			return nil, maskAny(err)
+		}
+		return &value, nil
+	}
+	content, err := renderTemplate(sourcePath, extract)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return content, nil
+}
+
+// CheckTemplateFile checks that all secrets used by the Go text template found at the given source path
+// can be extracted into the given target, without writing anything.
+// The template is rendered to find the secrets it uses. Secrets that cannot be extracted render as empty values.
+func (c *AuthenticatedVaultClient) CheckTemplateFile(target, sourcePath string) []AccessCheck {
+	result := []AccessCheck{}
+	checked := make(map[string]bool)
+	extract := func(secretPath, field string) (*string, error) {
+		key := secretPath + "#" + field
+		ok, found := checked[key]
+		if !found {
+			check := c.checkEnvSecret(target, EnvSecret{SecretPath: secretPath, SecretField: field})
+			result = append(result, check)
+			ok = check.OK()
+			checked[key] = ok
+		}
+		if !ok {
+			return nil, nil
+		}
+		value, err := c.extractSecret(secretPath, field)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		return &value, nil
+	}
+	if _, err := renderTemplate(sourcePath, extract); err != nil {
+		result = append(result, AccessCheck{
+			Target:       target,
+			Path:         sourcePath,
+			Capabilities: []string{},
+			Status:       AccessError,
+			Message:      "cannot render template: " + err.Error(),
+		})
+	}
+	return result
+}
+
+// renderTemplate renders the Go text template found at the given source path, using the given
+// function to extract secrets. A nil value returned by extract renders as an empty value.
+func renderTemplate(sourcePath string, extract func(secretPath, field string) (*string, error)) ([]byte, error) {
+	raw, err := ioutil.ReadFile(sourcePath)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	t, err := template.New(filepath.Base(sourcePath)).Option("missingkey=error").Funcs(templateFuncs(extract)).Parse(string(raw))
+	if err != nil {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot parse template %s: %s", sourcePath, err))
+	}
+	var buffer bytes.Buffer
+	if err := t.Execute(&buffer, nil); err != nil {
+		return nil, maskAny(err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// templateFuncs returns the functions that are available in templates, using the given
+// function to extract secrets.
+func templateFuncs(extract func(secretPath, field string) (*string, error)) template.FuncMap {
+	secret := func(secretPath string, secretField ...string) (*string, error) {
+		field := defaultSecretField
+		switch len(secretField) {
+		case 0:
+			// Use default field
+		case 1:
+			field = secretField[0]
+		default:
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "expected at most 1 field for %s", secretPath))
+		}
+		value, err := extract(secretPath, field)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		return value, nil
+	}
+	return template.FuncMap{
+		"secret": func(secretPath string, secretField ...string) (string, error) {
+			value, err := secret(secretPath, secretField...)
+			if err != nil {
+				return "", maskAny(err)
+			} else if value == nil {
+				return "", nil
+			}
+			return *value, nil
+		},
+		"secretJSON": func(secretPath string, secretField ...string) (interface{}, error) {
+			value, err := secret(secretPath, secretField...)
+			if err != nil {
+				return nil, maskAny(err)
+			} else if value == nil {
+				return nil, nil
+			}
+			var result interface{}
+			if err := json.Unmarshal([]byte(*value), &result); err != nil {
+				return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "secret at %s is not valid JSON: %s", secretPath, err))
+			}
+			return result, nil
+		},
+		"base64Decode": decodeBase64,
+		"env":          os.Getenv,
+	}
+}
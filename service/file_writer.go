@@ -0,0 +1,227 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	defaultSecretFileMode = os.FileMode(0400)
+)
+
+// FileOptions specifies the mode & ownership of a file written by vault-monkey.
+type FileOptions struct {
+	Mode  string // Octal mode of the file (defaults to the default mode of the target, mostly 0400)
+	Owner string // Name or uid of the owner of the file (defaults to the current user)
+	Group string // Name or gid of the group of the file (defaults to the group of the current user)
+	// AllowPersistent allows writing the file to a filesystem other than tmpfs or ramfs.
+	AllowPersistent bool
+	// RequireTmpfs enforces writing the file to tmpfs or ramfs. It cannot be combined with AllowPersistent.
+	RequireTmpfs bool
+}
+
+// Validate checks the options for errors.
+func (o FileOptions) Validate() error {
+	if _, err := parseFileMode(o.Mode, defaultSecretFileMode); err != nil {
+		return maskAny(err)
+	}
+	if _, _, err := lookupFileOwner(o.Owner, o.Group); err != nil {
+		return maskAny(err)
+	}
+	if o.AllowPersistent && o.RequireTmpfs {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "allowing persistent storage conflicts with requiring tmpfs"))
+	}
+	return nil
+}
+
+// checkStorage returns an error when the options do not allow writing the file with given path
+// to the filesystem it would be stored on.
+func (o FileOptions) checkStorage(path string) error {
+	if o.AllowPersistent && !o.RequireTmpfs {
+		return nil
+	}
+	if err := ensureNonPersistentStorage(path); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// ensureDirectoryOf creates the directory part of the given file path if needed.
+func ensureDirectoryOf(path string, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, perm); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// writeSecretFile writes the given content to a file with given path, that is (by default) only readable by its owner.
+func writeSecretFile(path string, content []byte, options FileOptions) error {
+	if _, err := writeFileIfChanged(path, content, options, defaultSecretFileMode); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// writeFileIfChanged writes the given content to a file with given path,
+// unless that file already contains exactly the given content.
+// The mode & ownership of the file are always set according to the given options.
+// Unless the options allow persistent storage, the file must be on tmpfs or ramfs.
+// The file is recorded as written by this process, so it can be removed by CleanupWrittenTargets (or Cleanup).
+// It returns true if the content of the file has been written.
+func writeFileIfChanged(path string, content []byte, options FileOptions, defaultMode os.FileMode) (bool, error) {
+	if err := options.checkStorage(path); err != nil {
+		return false, maskAny(err)
+	}
+	mode, err := parseFileMode(options.Mode, defaultMode)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	uid, gid, err := lookupFileOwner(options.Owner, options.Group)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	if existing, err := ioutil.ReadFile(path); err == nil && bytes.Equal(existing, content) {
+		if err := setFileAttributes(path, mode, uid, gid); err != nil {
+			return false, maskAny(err)
+		}
+		recordFile(path)
+		return false, nil
+	}
+	if err := writeFileAtomic(path, content, mode, uid, gid); err != nil {
+		return false, maskAny(err)
+	}
+	recordFile(path)
+	return true, nil
+}
+
+// writeFileAtomic writes the given content to a temporary file in the directory of the given path,
+// sets its mode & ownership, flushes it to disk and then renames it to the given path.
+// Readers never observe a partially written file and the existing file is left untouched on failure.
+// A uid or gid of -1 is not changed.
+func writeFileAtomic(path string, content []byte, mode os.FileMode, uid, gid int) error {
+	if err := ensureDirectoryOf(path, 0755); err != nil {
+		return maskAny(err)
+	}
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return maskAny(err)
+	}
+	tmpPath := f.Name()
+	success := false
+	defer func() {
+		if !success {
+			f.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+	if _, err := f.Write(content); err != nil {
+		return maskAny(err)
+	}
+	if err := f.Chmod(mode); err != nil {
+		return maskAny(err)
+	}
+	if uid != -1 || gid != -1 {
+		if err := f.Chown(uid, gid); err != nil {
+			return maskAny(err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return maskAny(err)
+	}
+	if err := f.Close(); err != nil {
+		return maskAny(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return maskAny(err)
+	}
+	success = true
+
+	// Make the rename durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// setFileAttributes sets the mode & ownership of the file with given path.
+// A uid or gid of -1 is not changed.
+func setFileAttributes(path string, mode os.FileMode, uid, gid int) error {
+	if err := os.Chmod(path, mode); err != nil {
+		return maskAny(err)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(path, uid, gid); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// lookupFileOwner resolves the given owner & group (names or numeric ids) into a uid & gid.
+// An empty owner or group results in -1, meaning "do not change".
+func lookupFileOwner(owner, group string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner != "" {
+		if id, err := strconv.Atoi(owner); err == nil {
+			uid = id
+		} else {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return -1, -1, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unknown owner '%s': %s", owner, err))
+			}
+			if uid, err = strconv.Atoi(u.Uid); err != nil {
+				return -1, -1, maskAny(err)
+			}
+		}
+	}
+	if group != "" {
+		if id, err := strconv.Atoi(group); err == nil {
+			gid = id
+		} else {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return -1, -1, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unknown group '%s': %s", group, err))
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return -1, -1, maskAny(err)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// parseFileMode parses an octal file mode (e.g. "0400").
+// An empty string results in the given default mode.
+func parseFileMode(mode string, defaultMode os.FileMode) (os.FileMode, error) {
+	if mode == "" {
+		return defaultMode, nil
+	}
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid file mode '%s'", mode))
+	}
+	return os.FileMode(value), nil
+}
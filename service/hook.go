@@ -0,0 +1,126 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/juju/errgo"
+	"github.com/op/go-logging"
+)
+
+var (
+	signalNames = map[string]syscall.Signal{
+		"SIGHUP":  syscall.SIGHUP,
+		"SIGINT":  syscall.SIGINT,
+		"SIGQUIT": syscall.SIGQUIT,
+		"SIGTERM": syscall.SIGTERM,
+		"SIGUSR1": syscall.SIGUSR1,
+		"SIGUSR2": syscall.SIGUSR2,
+	}
+)
+
+// ParseSignal converts a signal name (e.g. SIGHUP or HUP) into a signal.
+func ParseSignal(name string) (syscall.Signal, error) {
+	key := strings.ToUpper(name)
+	if !strings.HasPrefix(key, "SIG") {
+		key = "SIG" + key
+	}
+	if sig, ok := signalNames[key]; ok {
+		return sig, nil
+	}
+	return 0, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "unknown signal '%s'", name))
+}
+
+// ChangeHook specifies the actions taken after a target has been changed,
+// e.g. to let the process that uses the target reload it.
+type ChangeHook struct {
+	Command string         // If set, this command is run using `/bin/sh -c`
+	Signal  syscall.Signal // If set, this signal is sent to the process whose ID is found in PIDFile
+	PIDFile string         // Path of a file containing the ID of the process to signal
+}
+
+// IsSet returns true if the hook has any action.
+func (h ChangeHook) IsSet() bool {
+	return h.Command != "" || h.Signal != 0
+}
+
+// Run performs the actions of the hook.
+// The output & exit status of the command are logged.
+func (h ChangeHook) Run(log *logging.Logger) error {
+	if h.Command != "" {
+		log.Infof("Running '%s'", h.Command)
+		output, err := exec.Command("/bin/sh", "-c", h.Command).CombinedOutput()
+		for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+			if line != "" {
+				log.Infof("%s: %s", h.Command, line)
+			}
+		}
+		if err != nil {
+			log.Errorf("'%s' failed: %s", h.Command, err)
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "'%s' failed: %s", h.Command, err))
+		}
+		log.Infof("'%s' succeeded", h.Command)
+	}
+	if h.Signal != 0 {
+		raw, err := readID(h.PIDFile)
+		if err != nil {
+			return maskAny(err)
+		}
+		pid, err := strconv.Atoi(raw)
+		if err != nil || pid <= 0 {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid process ID '%s' in %s", raw, h.PIDFile))
+		}
+		log.Infof("Sending %s to process %d", h.Signal, pid)
+		if err := syscall.Kill(pid, h.Signal); err != nil {
+			log.Errorf("Cannot send %s to process %d: %s", h.Signal, pid, err)
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// NewHookTarget creates a WatchTarget that runs the given hook every time the given target has changed.
+func NewHookTarget(log *logging.Logger, target WatchTarget, hook ChangeHook) WatchTarget {
+	return &hookTarget{log: log, target: target, hook: hook}
+}
+
+type hookTarget struct {
+	log    *logging.Logger
+	target WatchTarget
+	hook   ChangeHook
+}
+
+// Update updates the wrapped target and runs the hook when it has changed.
+func (t *hookTarget) Update(c *AuthenticatedVaultClient) (bool, error) {
+	changed, err := t.target.Update(c)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	if changed {
+		if err := t.hook.Run(t.log); err != nil {
+			return true, maskAny(err)
+		}
+	}
+	return changed, nil
+}
+
+// String returns a human readable description of the target.
+func (t *hookTarget) String() string {
+	return t.target.String()
+}
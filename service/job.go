@@ -40,16 +40,18 @@ type Job interface {
 }
 
 // NewJob creates a new Job manipulator for the given vault client.
-func NewJob(vaultClient *api.Client, methods AuthMethod) Job {
+func NewJob(vaultClient *api.Client, methods []LoginMethod) Job {
 	return &job{
 		vaultClient: vaultClient,
+		kv:          newKVClient(vaultClient),
 		methods:     methods,
 	}
 }
 
 type job struct {
 	vaultClient *api.Client
-	methods     AuthMethod
+	kv          *kvClient
+	methods     []LoginMethod
 }
 
 // Create creates the authentication mapping for a job with given id.
@@ -57,35 +59,8 @@ func (c *job) Create(jobID, policyName string) error {
 	jobID = strings.ToLower(jobID)
 	policyName = strings.ToLower(policyName)
 
-	if c.methods.IsEnabled(AuthMethodAppRole) {
-		// Create role
-		{
-			path := fmt.Sprintf("auth/approle/role/%s", jobID)
-			data := make(map[string]interface{})
-			data["role_name"] = jobID
-			data["bind_secret_id"] = true
-			data["policies"] = policyName
-			data["secret_id_num_uses"] = 0
-			if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
-				return maskAny(err)
-			}
-		}
-		// Set role_id
-		{
-			path := fmt.Sprintf("auth/approle/role/%s/role-id", jobID)
-			data := make(map[string]interface{})
-			data["role_id"] = jobID
-			if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
-				return maskAny(err)
-			}
-		}
-	}
-	if c.methods.IsEnabled(AuthMethodAppID) {
-		path := fmt.Sprintf("auth/app-id/map/app-id/%s", jobID)
-		data := make(map[string]interface{})
-		data["value"] = policyName
-		data["display_name"] = jobID
-		if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
+	for _, m := range c.methods {
+		if err := m.CreateRole(c.vaultClient, jobID, policyName); err != nil {
 			return maskAny(err)
 		}
 	}
@@ -96,88 +71,137 @@ func (c *job) Create(jobID, policyName string) error {
 func (c *job) Delete(jobID string) error {
 	jobID = strings.ToLower(jobID)
 
-	if c.methods.IsEnabled(AuthMethodAppRole) {
-		path := fmt.Sprintf("auth/approle/role/%s", jobID)
-		if _, err := c.vaultClient.Logical().Delete(path); err != nil {
+	for _, m := range c.methods {
+		if err := m.DeleteRole(c.vaultClient, jobID); err != nil {
 			return maskAny(err)
 		}
 	}
-	if c.methods.IsEnabled(AuthMethodAppID) {
-		path := fmt.Sprintf("auth/app-id/map/app-id/%s", jobID)
-		if _, err := c.vaultClient.Logical().Delete(path); err != nil {
-			return maskAny(err)
-		}
-		// TODO remove all user-id mappings for this job-id (don't see a way how yet)
-		// TODO remove all tokens created for this app-id (don't see a way how yet)
-	}
 	return nil
 }
 
 // AllowCluster creates the user-id mapping for allowing a cluster access to the secrets of a job.
+// A job ID with a '@<version>' suffix re-uses the user-id of that version of an existing mapping and
+// pins the cluster policy to that version (KV version 2 only). Otherwise a new user-id is written
+// as the latest version and any pinned version of the job is removed.
+// An outdated cluster policy is rewritten.
 func (c *job) AllowCluster(jobID, clusterID string) error {
-	jobID = strings.ToLower(jobID)
-	clusterID = strings.ToLower(clusterID)
-	userID := strings.ToLower(uniuri.NewLen(jobUserIdLen))
-
-	// Create mapping
-	userIDPath := fmt.Sprintf(clusterAuthPathTmpl, clusterID, jobID)
-	userIDData := make(map[string]interface{})
-	userIDData[clusterAuthUserIdField] = userID
-	if _, err := c.vaultClient.Logical().Write(userIDPath, userIDData); err != nil {
+	jobID, version, clusterID, err := splitJobClusterIDs(jobID, clusterID)
+	if err != nil {
 		return maskAny(err)
 	}
-
-	if c.methods.IsEnabled(AuthMethodAppRole) {
-		path := fmt.Sprintf("auth/approle/role/%s/custom-secret-id", jobID)
-		data := make(map[string]interface{})
-		data["secret_id"] = userID
-		if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
+	if version != 0 {
+		// The pin is stored in the cluster policy, so that must exist
+		policy, err := c.vaultClient.Sys().GetPolicy(fmt.Sprintf(clusterPolicyNameTmpl, clusterID))
+		if err != nil {
 			return maskAny(err)
 		}
+		if policy == "" {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot pin version %d for cluster %s, the cluster has no policy (create the cluster first)", version, clusterID))
+		}
 	}
-	if c.methods.IsEnabled(AuthMethodAppID) {
-		// Map user-id
-		path := fmt.Sprintf("auth/app-id/map/user-id/%s", userID)
-		data := make(map[string]interface{})
-		data["value"] = jobID
-		if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
+	userIDPath := fmt.Sprintf(clusterAuthPathTmpl, clusterID, jobID)
+	var userID interface{}
+	if version != 0 {
+		// Re-use the user-id of the pinned version
+		if userID, err = c.readUserID(userIDPath, version); err != nil {
+			return maskAny(err)
+		}
+	} else {
+		// Create mapping
+		userID = strings.ToLower(uniuri.NewLen(jobUserIdLen))
+		userIDData := make(map[string]interface{})
+		userIDData[clusterAuthUserIdField] = userID
+		if err := c.kv.write(userIDPath, userIDData); err != nil {
 			return maskAny(err)
 		}
 	}
+
+	for _, m := range c.methods {
+		if err := m.AddSecret(c.vaultClient, jobID, userID, ""); err != nil {
+			return maskAny(err)
+		}
+	}
+
+	_, err = updateClusterPolicy(c.vaultClient, c.kv, clusterID, func(pins map[string]int) {
+		if version != 0 {
+			pins[jobID] = version
+		} else {
+			delete(pins, jobID)
+		}
+	})
+	if err != nil {
+		return maskAny(err)
+	}
 	return nil
 }
 
 // DenyCluster removes the user-id mapping so the cluster is denied access to the secrets of a job.
+// A job ID with a '@<version>' suffix removes the user-id of that version of the mapping,
+// otherwise the user-id of the latest version is removed.
+// A version of the job pinned in the cluster policy is removed (unless another version is denied).
+// An outdated cluster policy is rewritten.
 func (c *job) DenyCluster(jobID, clusterID string) error {
-	jobID = strings.ToLower(jobID)
-	clusterID = strings.ToLower(clusterID)
+	jobID, version, clusterID, err := splitJobClusterIDs(jobID, clusterID)
+	if err != nil {
+		return maskAny(err)
+	}
 	// Read the user id
 	userIDPath := fmt.Sprintf(clusterAuthPathTmpl, clusterID, jobID)
-	userIDSecret, err := c.vaultClient.Logical().Read(userIDPath)
+	userID, err := c.readUserID(userIDPath, version)
 	if err != nil {
 		return maskAny(err)
 	}
 
+	for _, m := range c.methods {
+		if err := m.RemoveSecret(c.vaultClient, jobID, userID); err != nil {
+			return maskAny(err)
+		}
+	}
+
+	if _, err := updateClusterPolicy(c.vaultClient, c.kv, clusterID, func(pins map[string]int) {
+		if version == 0 || pins[jobID] == version {
+			delete(pins, jobID)
+		}
+	}); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// readUserID reads the user-id field of the given version (0 means latest) of the mapping at the given path.
+func (c *job) readUserID(userIDPath string, version int) (interface{}, error) {
+	userIDSecret, err := c.kv.read(userIDPath, version)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if userIDSecret == nil || userIDSecret.Data == nil {
+		return nil, maskAny(errgo.WithCausef(nil, VaultError, "no user-id found at '%s'", versionedPath(userIDPath, version)))
+	}
+
 	// Fetch user-id field
 	userID, ok := userIDSecret.Data[clusterAuthUserIdField]
 	if !ok {
-		return maskAny(errgo.WithCausef(nil, VaultError, "missing 'user-id' field at '%s'", userIDPath))
+		return nil, maskAny(errgo.WithCausef(nil, VaultError, "missing 'user-id' field at '%s'", versionedPath(userIDPath, version)))
 	}
+	return userID, nil
+}
 
-	if c.methods.IsEnabled(AuthMethodAppRole) {
-		path := fmt.Sprintf("/auth/approle/role/%s/secret-id/destroy", jobID)
-		data := make(map[string]interface{})
-		data["secret_id"] = userID
-		if _, err := c.vaultClient.Logical().Write(path, data); err != nil {
-			return maskAny(err)
-		}
+// splitJobClusterIDs normalizes the given job & cluster ID and splits the optional '@<version>' suffix
+// (pinning a version of the user-id mapping) from the job ID.
+// Since the cluster ID is not the last element of the path of the mapping, it cannot have a version suffix.
+func splitJobClusterIDs(jobID, clusterID string) (string, int, string, error) {
+	jobID, version := splitSecretVersion(strings.ToLower(jobID))
+	clusterID = strings.ToLower(clusterID)
+	if _, clusterVersion := splitSecretVersion(clusterID); clusterVersion != 0 {
+		return "", 0, "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cluster ID '%s' cannot have a version suffix, add it to the job ID instead", clusterID))
 	}
-	if c.methods.IsEnabled(AuthMethodAppID) {
-		// Remove user-id map
-		path := fmt.Sprintf("auth/app-id/map/user-id/%s", userID)
-		if _, err := c.vaultClient.Logical().Delete(path); err != nil {
-			return maskAny(err)
-		}
+	return jobID, version, clusterID, nil
+}
+
+// versionedPath returns the given path with a '@<version>' suffix if the given version is not 0.
+func versionedPath(secretPath string, version int) string {
+	if version == 0 {
+		return secretPath
 	}
-	return nil
+	return fmt.Sprintf("%s%s%d", secretPath, secretVersionSeparator, version)
 }
@@ -0,0 +1,160 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strings"
+
+	k8s "github.com/YakLabs/k8s-client"
+	"github.com/juju/errgo"
+)
+
+const (
+	// KubernetesPathsAnnotation is the annotation of a Kubernetes secret that specifies the secrets
+	// synced into it by the controller: '<key>=<path>[#<field>]' entries, separated by newlines or commas.
+	KubernetesPathsAnnotation = "vault-monkey.pulcy.com/paths"
+)
+
+// ParseKubernetesPathsAnnotation parses the value of a KubernetesPathsAnnotation into EnvSecrets.
+func ParseKubernetesPathsAnnotation(value string) ([]EnvSecret, error) {
+	result := []EnvSecret{}
+	for _, entry := range splitKubernetesPathsAnnotation(value) {
+		secret, err := ParseEnvSecret(entry)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		if err := secret.Validate(); err != nil {
+			return nil, maskAny(err)
+		}
+		result = append(result, secret)
+	}
+	if len(result) == 0 {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "no secrets specified in %s annotation", KubernetesPathsAnnotation))
+	}
+	return result, nil
+}
+
+// splitKubernetesPathsAnnotation returns the non-empty entries of a KubernetesPathsAnnotation.
+func splitKubernetesPathsAnnotation(value string) []string {
+	var result []string
+	for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == '\n' || r == ',' }) {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// NewKubernetesSecretSyncTarget creates a WatchTarget that fills all Kubernetes secrets in the namespace
+// of the given client that carry a KubernetesPathsAnnotation with the secrets specified in that annotation.
+// Only secrets below one of the given path prefixes can be synced, since anyone who can annotate a
+// Kubernetes secret can request any secret the controller has access to.
+func NewKubernetesSecretSyncTarget(client *K8sClient, allowedPathPrefixes []string) (WatchTarget, error) {
+	var prefixes []string
+	for _, prefix := range allowedPathPrefixes {
+		if prefix = strings.Trim(strings.TrimSpace(prefix), "/"); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "at least one allowed path prefix is required"))
+	}
+	return &k8sSecretSyncTarget{client: client, allowedPathPrefixes: prefixes}, nil
+}
+
+type k8sSecretSyncTarget struct {
+	client              *K8sClient
+	allowedPathPrefixes []string
+}
+
+// Update lists all annotated Kubernetes secrets and syncs them.
+// A failure to sync one secret does not prevent syncing the others.
+func (t *k8sSecretSyncTarget) Update(c *AuthenticatedVaultClient) (bool, error) {
+	list, err := t.client.c.ListSecrets(t.client.namespace, nil)
+	if err != nil {
+		return false, maskAny(errgo.WithCausef(nil, KubernetesError, "cannot list kubernetes secrets: %s", err))
+	}
+	changed := false
+	failed := 0
+	for _, secret := range list.Items {
+		annotation, found := secret.Annotations[KubernetesPathsAnnotation]
+		if !found {
+			continue
+		}
+		written, err := t.sync(c, secret, annotation)
+		if err != nil {
+			c.log.Errorf("Failed to sync kubernetes secret %s: %s", secret.Name, Describe(err))
+			failed++
+			continue
+		}
+		if written {
+			c.log.Infof("Updated kubernetes secret %s", secret.Name)
+			changed = true
+		}
+	}
+	if failed > 0 {
+		return changed, maskAny(errgo.WithCausef(nil, KubernetesError, "failed to sync %d kubernetes secret(s)", failed))
+	}
+	return changed, nil
+}
+
+// sync extracts the secrets specified in the given annotation into the given Kubernetes secret.
+func (t *k8sSecretSyncTarget) sync(c *AuthenticatedVaultClient, secret k8s.Secret, annotation string) (bool, error) {
+	secrets, err := ParseKubernetesPathsAnnotation(annotation)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	for _, s := range secrets {
+		if !t.isAllowedPath(s.SecretPath) {
+			return false, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "path '%s' is not below any of the allowed path prefixes (%s)", s.SecretPath, strings.Join(t.allowedPathPrefixes, ", ")))
+		}
+	}
+	vars, err := c.extractKubernetesSecrets(secrets)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	// Keep the type of the existing secret.
+	// The secret is declared by its user, so the keys added to it are not recorded for cleanup.
+	options := KubernetesSecretOptions{Type: string(secret.Type)}
+	written, _, err := t.client.writeKubernetesSecretData(secret.Name, vars, options, envSecretPaths(secrets))
+	if err != nil {
+		return false, maskAny(err)
+	}
+	return written, nil
+}
+
+// isAllowedPath returns true if the given secret path (with optional '@<version>' suffix) is equal to,
+// or below one of the allowed path prefixes.
+func (t *k8sSecretSyncTarget) isAllowedPath(secretPath string) bool {
+	secretPath, _ = splitSecretVersion(secretPath)
+	secretPath = strings.Trim(secretPath, "/")
+	for _, segment := range strings.Split(secretPath, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			// Do not try to interpret relative paths
+			return false
+		}
+	}
+	for _, prefix := range t.allowedPathPrefixes {
+		if secretPath == prefix || strings.HasPrefix(secretPath, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a human readable description of the target.
+func (t *k8sSecretSyncTarget) String() string {
+	return "kubernetes secrets in namespace " + t.client.namespace
+}
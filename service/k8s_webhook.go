@@ -0,0 +1,304 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	k8s "github.com/YakLabs/k8s-client"
+	"github.com/juju/errgo"
+	"github.com/op/go-logging"
+)
+
+const (
+	// KubernetesInjectAnnotation is the annotation of a pod that enables injection of a vault-monkey init container
+	// by the webhook. Its value must be "true".
+	KubernetesInjectAnnotation = "vault-monkey.pulcy.com/inject"
+	// KubernetesJobIDAnnotation is the annotation of a pod that specifies the job ID used by the injected init container.
+	KubernetesJobIDAnnotation = "vault-monkey.pulcy.com/job-id"
+	// KubernetesFormatAnnotation is the annotation of a pod that specifies the format of the environment file
+	// written by the injected init container.
+	KubernetesFormatAnnotation = "vault-monkey.pulcy.com/format"
+	// KubernetesInjectedAnnotation is the annotation added to a pod by the webhook once it has been patched.
+	KubernetesInjectedAnnotation = "vault-monkey.pulcy.com/injected"
+
+	// WebhookSecretsMountPath is the path at which the shared in-memory volume is mounted in all containers.
+	WebhookSecretsMountPath = "/vault-monkey"
+	// WebhookSecretsFileName is the name of the environment file written into the shared volume.
+	WebhookSecretsFileName = "secrets.env"
+
+	webhookContainerName  = "vault-monkey"
+	webhookVolumeName     = "vault-monkey-secrets"
+	webhookPodNameEnvVar  = "VAULT_MONKEY_POD_NAME"
+	webhookPodIPEnvVar    = "VAULT_MONKEY_POD_IP"
+	webhookNodeNameEnvVar = "VAULT_MONKEY_NODE_NAME"
+	webhookMaxRequestSize = 4 * 1024 * 1024
+)
+
+// WebhookConfig holds the settings of the injected init container.
+type WebhookConfig struct {
+	Image           string // Image containing the vault-monkey binary as entrypoint
+	ImagePullPolicy string // Pull policy of the image (defaults to IfNotPresent)
+	VaultAddr       string // URL of the vault passed to the init container (if set)
+	// Kubernetes auth method mount passed to the init container (if set)
+	KubernetesAuthMount string
+	AuthMethods         []string // Authentication methods passed to the init container (if set)
+}
+
+// AdmissionReview is the subset of a Kubernetes AdmissionReview (admission.k8s.io/v1 or v1beta1) used by the webhook.
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion,omitempty"`
+	Kind       string             `json:"kind,omitempty"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+// AdmissionRequest is the subset of a Kubernetes AdmissionRequest used by the webhook.
+type AdmissionRequest struct {
+	UID       string          `json:"uid"`
+	Namespace string          `json:"namespace,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Object    json.RawMessage `json:"object,omitempty"`
+}
+
+// AdmissionResponse is a Kubernetes AdmissionResponse.
+type AdmissionResponse struct {
+	UID       string      `json:"uid"`
+	Allowed   bool        `json:"allowed"`
+	Result    *k8s.Status `json:"status,omitempty"`
+	PatchType string      `json:"patchType,omitempty"`
+	Patch     []byte      `json:"patch,omitempty"`
+}
+
+// JSONPatchOperation is a single operation of a JSONPatch (RFC 6902).
+type JSONPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// webhookPod holds the fields of a pod that determine the patch.
+// Arrays are kept raw, since only their presence & length matter.
+type webhookPod struct {
+	Metadata struct {
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		InitContainers []json.RawMessage `json:"initContainers,omitempty"`
+		Containers     []struct {
+			VolumeMounts []json.RawMessage `json:"volumeMounts,omitempty"`
+		} `json:"containers,omitempty"`
+		Volumes []json.RawMessage `json:"volumes,omitempty"`
+	} `json:"spec"`
+}
+
+// NewWebhookHandler creates an HTTP handler that answers AdmissionReview requests for pods.
+func NewWebhookHandler(log *logging.Logger, config WebhookConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, webhookMaxRequestSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := config.ReviewPod(log, body)
+		if err != nil {
+			log.Errorf("Invalid admission review: %s", Describe(err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	})
+}
+
+// ReviewPod answers the given (JSON encoded) AdmissionReview for a pod with an (JSON encoded) AdmissionReview
+// that contains a JSONPatch when the pod must be injected.
+// Pods with invalid vault-monkey annotations are rejected.
+func (config WebhookConfig) ReviewPod(log *logging.Logger, review []byte) ([]byte, error) {
+	var input AdmissionReview
+	if err := json.Unmarshal(review, &input); err != nil {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot decode admission review: %s", err))
+	}
+	if input.Request == nil {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "admission review contains no request"))
+	}
+	response := &AdmissionResponse{
+		UID:     input.Request.UID,
+		Allowed: true,
+	}
+	patch, err := config.PodPatch(input.Request.Object)
+	if err != nil {
+		log.Warningf("Rejecting pod %s in namespace %s: %s", input.Request.Name, input.Request.Namespace, Describe(err))
+		response.Allowed = false
+		response.Result = &k8s.Status{Message: err.Error()}
+	} else if len(patch) > 0 {
+		log.Infof("Injecting vault-monkey into pod %s in namespace %s", input.Request.Name, input.Request.Namespace)
+		raw, err := json.Marshal(patch)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		response.PatchType = "JSONPatch"
+		response.Patch = raw
+	}
+	output := AdmissionReview{
+		APIVersion: input.APIVersion,
+		Kind:       input.Kind,
+		Response:   response,
+	}
+	raw, err := json.Marshal(output)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return raw, nil
+}
+
+// PodPatch returns the JSONPatch operations needed to inject vault-monkey into the given (JSON encoded) pod.
+// It returns no operations when the pod is not annotated for injection or has already been injected.
+func (config WebhookConfig) PodPatch(rawPod []byte) ([]JSONPatchOperation, error) {
+	var pod webhookPod
+	if err := json.Unmarshal(rawPod, &pod); err != nil {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot decode pod: %s", err))
+	}
+	annotations := pod.Metadata.Annotations
+	if annotations[KubernetesInjectAnnotation] != "true" || annotations[KubernetesInjectedAnnotation] != "" {
+		return nil, nil
+	}
+	initContainer, err := config.initContainer(annotations)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+
+	var patch []JSONPatchOperation
+	// Run the init container before any other init container, so they can use the secrets too.
+	if len(pod.Spec.InitContainers) == 0 {
+		patch = append(patch, JSONPatchOperation{Op: "add", Path: "/spec/initContainers", Value: []k8s.Container{initContainer}})
+	} else {
+		patch = append(patch, JSONPatchOperation{Op: "add", Path: "/spec/initContainers/0", Value: initContainer})
+	}
+	volume := k8s.Volume{
+		Name: webhookVolumeName,
+		VolumeSource: k8s.VolumeSource{
+			EmptyDir: &k8s.EmptyDirVolumeSource{Medium: "Memory"},
+		},
+	}
+	patch = appendJSONPatchAdd(patch, "/spec/volumes", len(pod.Spec.Volumes) > 0, volume)
+	mount := k8s.VolumeMount{
+		Name:      webhookVolumeName,
+		ReadOnly:  true,
+		MountPath: WebhookSecretsMountPath,
+	}
+	for i, c := range pod.Spec.Containers {
+		patch = appendJSONPatchAdd(patch, jsonPointer("spec", "containers", i, "volumeMounts"), len(c.VolumeMounts) > 0, mount)
+	}
+	if len(annotations) == 0 {
+		patch = append(patch, JSONPatchOperation{Op: "add", Path: "/metadata/annotations", Value: map[string]string{KubernetesInjectedAnnotation: "true"}})
+	} else {
+		patch = append(patch, JSONPatchOperation{Op: "add", Path: jsonPointer("metadata", "annotations", KubernetesInjectedAnnotation), Value: "true"})
+	}
+	return patch, nil
+}
+
+// initContainer creates the init container that extracts the secrets specified in the given pod annotations.
+func (config WebhookConfig) initContainer(annotations map[string]string) (k8s.Container, error) {
+	if config.Image == "" {
+		return k8s.Container{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "no image specified"))
+	}
+	jobID := annotations[KubernetesJobIDAnnotation]
+	if jobID == "" {
+		return k8s.Container{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "%s annotation is missing", KubernetesJobIDAnnotation))
+	}
+	paths := annotations[KubernetesPathsAnnotation]
+	if _, err := ParseKubernetesPathsAnnotation(paths); err != nil {
+		return k8s.Container{}, maskAny(err)
+	}
+	format := annotations[KubernetesFormatAnnotation]
+	if _, err := GetEnvFormat(format); err != nil {
+		return k8s.Container{}, maskAny(err)
+	}
+
+	args := []string{
+		"extract", "env",
+		"--target=" + path.Join(WebhookSecretsMountPath, WebhookSecretsFileName),
+		"--job-id=" + jobID,
+		"--kubernetes-pod-name=$(" + webhookPodNameEnvVar + ")",
+		"--kubernetes-pod-ip=$(" + webhookPodIPEnvVar + ")",
+		"--kubernetes-node-name=$(" + webhookNodeNameEnvVar + ")",
+	}
+	if format != "" {
+		args = append(args, "--format="+format)
+	}
+	if config.KubernetesAuthMount != "" {
+		args = append(args, "--vault-kubernetes-auth-mount="+config.KubernetesAuthMount)
+	}
+	if len(config.AuthMethods) > 0 {
+		args = append(args, "--auth-methods="+strings.Join(config.AuthMethods, ","))
+	}
+	args = append(args, splitKubernetesPathsAnnotation(paths)...)
+	env := []k8s.EnvVar{
+		{Name: webhookPodNameEnvVar, ValueFrom: &k8s.EnvVarSource{FieldRef: &k8s.ObjectFieldSelector{APIVersion: "v1", FieldPath: "metadata.name"}}},
+		{Name: webhookPodIPEnvVar, ValueFrom: &k8s.EnvVarSource{FieldRef: &k8s.ObjectFieldSelector{APIVersion: "v1", FieldPath: "status.podIP"}}},
+		{Name: webhookNodeNameEnvVar, ValueFrom: &k8s.EnvVarSource{FieldRef: &k8s.ObjectFieldSelector{APIVersion: "v1", FieldPath: "spec.nodeName"}}},
+	}
+	if config.VaultAddr != "" {
+		env = append(env, k8s.EnvVar{Name: "VAULT_ADDR", Value: config.VaultAddr})
+	}
+	pullPolicy := k8s.PullPolicy(config.ImagePullPolicy)
+	if pullPolicy == "" {
+		pullPolicy = k8s.PullIfNotPresent
+	}
+	return k8s.Container{
+		Name:            webhookContainerName,
+		Image:           config.Image,
+		Args:            args,
+		Env:             env,
+		VolumeMounts:    []k8s.VolumeMount{{Name: webhookVolumeName, MountPath: WebhookSecretsMountPath}},
+		ImagePullPolicy: pullPolicy,
+	}, nil
+}
+
+// appendJSONPatchAdd appends an operation that adds the given value to the array at the given path.
+// When the array does not exist yet, it is created.
+func appendJSONPatchAdd(patch []JSONPatchOperation, arrayPath string, exists bool, value interface{}) []JSONPatchOperation {
+	if exists {
+		return append(patch, JSONPatchOperation{Op: "add", Path: arrayPath + "/-", Value: value})
+	}
+	return append(patch, JSONPatchOperation{Op: "add", Path: arrayPath, Value: []interface{}{value}})
+}
+
+// jsonPointer creates a JSON pointer (RFC 6901) from the given tokens.
+func jsonPointer(tokens ...interface{}) string {
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+	result := ""
+	for _, t := range tokens {
+		var s string
+		switch t := t.(type) {
+		case int:
+			s = strconv.Itoa(t)
+		default:
+			s = escaper.Replace(t.(string))
+		}
+		result += "/" + s
+	}
+	return result
+}
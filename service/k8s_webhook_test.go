@@ -0,0 +1,203 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+var testWebhookConfig = WebhookConfig{
+	Image: "pulcy/vault-monkey:latest",
+}
+
+// testAdmissionReview creates a (JSON encoded) AdmissionReview for the given (JSON encoded) pod.
+func testAdmissionReview(t *testing.T, pod string) []byte {
+	raw, err := json.Marshal(AdmissionReview{
+		APIVersion: "admission.k8s.io/v1",
+		Kind:       "AdmissionReview",
+		Request: &AdmissionRequest{
+			UID:       "uid-1",
+			Namespace: "default",
+			Name:      "test",
+			Object:    json.RawMessage(pod),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Cannot encode admission review: %s", err)
+	}
+	return raw
+}
+
+func TestPodPatch(t *testing.T) {
+	tests := []struct {
+		Name      string
+		Pod       string
+		Paths     []string // Expected paths of the patch operations
+		ExpectErr bool
+	}{
+		{
+			Name: "not annotated",
+			Pod:  `{"metadata":{},"spec":{"containers":[{"name":"app"}]}}`,
+		},
+		{
+			Name: "no initContainers",
+			Pod: `{"metadata":{"annotations":{"vault-monkey.pulcy.com/inject":"true","vault-monkey.pulcy.com/job-id":"job1","vault-monkey.pulcy.com/paths":"DB_USER=/secret/db#user"}},
+				"spec":{"containers":[{"name":"app"}]}}`,
+			Paths: []string{
+				"/spec/initContainers",
+				"/spec/volumes",
+				"/spec/containers/0/volumeMounts",
+				"/metadata/annotations/vault-monkey.pulcy.com~1injected",
+			},
+		},
+		{
+			Name: "existing arrays",
+			Pod: `{"metadata":{"annotations":{"vault-monkey.pulcy.com/inject":"true","vault-monkey.pulcy.com/job-id":"job1","vault-monkey.pulcy.com/paths":"DB_USER=/secret/db#user"}},
+				"spec":{
+					"initContainers":[{"name":"init"}],
+					"containers":[{"name":"app","volumeMounts":[{"name":"data","mountPath":"/data"}]},{"name":"sidecar"}],
+					"volumes":[{"name":"data","emptyDir":{}}]}}`,
+			Paths: []string{
+				"/spec/initContainers/0",
+				"/spec/volumes/-",
+				"/spec/containers/0/volumeMounts/-",
+				"/spec/containers/1/volumeMounts",
+				"/metadata/annotations/vault-monkey.pulcy.com~1injected",
+			},
+		},
+		{
+			Name: "already injected",
+			Pod: `{"metadata":{"annotations":{"vault-monkey.pulcy.com/inject":"true","vault-monkey.pulcy.com/injected":"true","vault-monkey.pulcy.com/job-id":"job1","vault-monkey.pulcy.com/paths":"DB_USER=/secret/db#user"}},
+				"spec":{"initContainers":[{"name":"vault-monkey"}],"containers":[{"name":"app"}]}}`,
+		},
+		{
+			Name: "missing job-id",
+			Pod: `{"metadata":{"annotations":{"vault-monkey.pulcy.com/inject":"true","vault-monkey.pulcy.com/paths":"DB_USER=/secret/db#user"}},
+				"spec":{"containers":[{"name":"app"}]}}`,
+			ExpectErr: true,
+		},
+	}
+
+	log := logging.MustGetLogger("test")
+	for _, test := range tests {
+		patch, err := testWebhookConfig.PodPatch([]byte(test.Pod))
+		if test.ExpectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got none", test.Name)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Name, err)
+		} else {
+			var paths []string
+			for _, op := range patch {
+				if op.Op != "add" {
+					t.Errorf("%s: expected add operation, got '%s' at %s", test.Name, op.Op, op.Path)
+				}
+				paths = append(paths, op.Path)
+			}
+			if !reflect.DeepEqual(paths, test.Paths) {
+				t.Errorf("%s: expected patch paths %v, got %v", test.Name, test.Paths, paths)
+			}
+		}
+
+		// The same pod through a complete AdmissionReview
+		raw, err := testWebhookConfig.ReviewPod(log, testAdmissionReview(t, test.Pod))
+		if err != nil {
+			t.Errorf("%s: review failed: %s", test.Name, err)
+			continue
+		}
+		var review AdmissionReview
+		if err := json.Unmarshal(raw, &review); err != nil {
+			t.Errorf("%s: cannot decode review response: %s", test.Name, err)
+			continue
+		}
+		response := review.Response
+		if response == nil {
+			t.Errorf("%s: review contains no response", test.Name)
+			continue
+		}
+		if response.UID != "uid-1" {
+			t.Errorf("%s: expected response UID 'uid-1', got '%s'", test.Name, response.UID)
+		}
+		if response.Allowed == test.ExpectErr {
+			t.Errorf("%s: expected allowed=%v, got %v", test.Name, !test.ExpectErr, response.Allowed)
+		}
+		if test.ExpectErr {
+			if response.Result == nil || response.Result.Message == "" {
+				t.Errorf("%s: expected a rejection message", test.Name)
+			}
+			continue
+		}
+		if len(test.Paths) == 0 {
+			if len(response.Patch) != 0 || response.PatchType != "" {
+				t.Errorf("%s: expected no patch, got %s", test.Name, response.Patch)
+			}
+			continue
+		}
+		if response.PatchType != "JSONPatch" {
+			t.Errorf("%s: expected patch type JSONPatch, got '%s'", test.Name, response.PatchType)
+		}
+		var ops []JSONPatchOperation
+		if err := json.Unmarshal(response.Patch, &ops); err != nil {
+			t.Errorf("%s: cannot decode patch: %s", test.Name, err)
+		} else if len(ops) != len(test.Paths) {
+			t.Errorf("%s: expected %d patch operations, got %d", test.Name, len(test.Paths), len(ops))
+		}
+	}
+}
+
+func TestPodPatchInitContainer(t *testing.T) {
+	pod := `{"metadata":{"annotations":{"vault-monkey.pulcy.com/inject":"true","vault-monkey.pulcy.com/job-id":"job1","vault-monkey.pulcy.com/paths":"DB_USER=/secret/db#user,DB_PASSWORD=/secret/db#password"}},
+		"spec":{"containers":[{"name":"app"}]}}`
+	patch, err := testWebhookConfig.PodPatch([]byte(pod))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	raw, err := json.Marshal(patch[0].Value)
+	if err != nil {
+		t.Fatalf("Cannot encode init containers: %s", err)
+	}
+	var containers []struct {
+		Name  string   `json:"name"`
+		Image string   `json:"image"`
+		Args  []string `json:"args"`
+	}
+	if err := json.Unmarshal(raw, &containers); err != nil {
+		t.Fatalf("Cannot decode init containers: %s", err)
+	}
+	if len(containers) != 1 {
+		t.Fatalf("Expected 1 init container, got %d", len(containers))
+	}
+	c := containers[0]
+	if c.Name != webhookContainerName || c.Image != testWebhookConfig.Image {
+		t.Errorf("Unexpected init container %s (%s)", c.Name, c.Image)
+	}
+	expectedArgs := []string{"--job-id=job1", "DB_USER=/secret/db#user", "DB_PASSWORD=/secret/db#password"}
+	for _, expected := range expectedArgs {
+		found := false
+		for _, arg := range c.Args {
+			if arg == expected {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected argument '%s' in %v", expected, c.Args)
+		}
+	}
+}
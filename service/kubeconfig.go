@@ -0,0 +1,184 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/errgo"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	defaultKubernetesNamespace = "default"
+)
+
+// kubeConfig is the subset of a kubeconfig file used to build a kubernetes client.
+type kubeConfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster   string `yaml:"cluster"`
+			User      string `yaml:"user"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// newKubeConfigConnection creates a kubernetes connection from the given kubeconfig file, using the given context
+// (or the current context if empty).
+// It returns the connection and the namespace of the context.
+func newKubeConfigConnection(kubeConfigPath, contextName string) (kubernetesConnection, string, error) {
+	raw, err := ioutil.ReadFile(kubeConfigPath)
+	if err != nil {
+		return kubernetesConnection{}, "", maskAny(err)
+	}
+	var cfg kubeConfig
+	if err := yaml.Unmarshal(raw, &cfg); err != nil {
+		return kubernetesConnection{}, "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot parse kubeconfig %s: %s", kubeConfigPath, err))
+	}
+	if contextName == "" {
+		contextName = cfg.CurrentContext
+	}
+	if contextName == "" {
+		return kubernetesConnection{}, "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "no context specified and kubeconfig %s has no current-context", kubeConfigPath))
+	}
+
+	// Find context, cluster & user
+	contextIndex, clusterIndex, userIndex := -1, -1, -1
+	for i, c := range cfg.Contexts {
+		if c.Name == contextName {
+			contextIndex = i
+		}
+	}
+	if contextIndex < 0 {
+		return kubernetesConnection{}, "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "context '%s' not found in kubeconfig %s", contextName, kubeConfigPath))
+	}
+	context := cfg.Contexts[contextIndex].Context
+	for i, c := range cfg.Clusters {
+		if c.Name == context.Cluster {
+			clusterIndex = i
+		}
+	}
+	if clusterIndex < 0 {
+		return kubernetesConnection{}, "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cluster '%s' of context '%s' not found in kubeconfig %s", context.Cluster, contextName, kubeConfigPath))
+	}
+	for i, u := range cfg.Users {
+		if u.Name == context.User {
+			userIndex = i
+		}
+	}
+	if context.User != "" && userIndex < 0 {
+		return kubernetesConnection{}, "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "user '%s' of context '%s' not found in kubeconfig %s", context.User, contextName, kubeConfigPath))
+	}
+
+	// Build client options
+	dir := filepath.Dir(kubeConfigPath)
+	cluster := cfg.Clusters[clusterIndex].Cluster
+	if cluster.Server == "" {
+		return kubernetesConnection{}, "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cluster '%s' has no server", context.Cluster))
+	}
+	config := kubernetesConnectionConfig{
+		Server:             cluster.Server,
+		InsecureSkipVerify: cluster.InsecureSkipTLSVerify,
+	}
+	ca, err := kubeConfigData(dir, cluster.CertificateAuthority, cluster.CertificateAuthorityData)
+	if err != nil {
+		return kubernetesConnection{}, "", maskAny(err)
+	}
+	config.CA = ca
+	if userIndex >= 0 {
+		user := cfg.Users[userIndex].User
+		cert, err := kubeConfigData(dir, user.ClientCertificate, user.ClientCertificateData)
+		if err != nil {
+			return kubernetesConnection{}, "", maskAny(err)
+		}
+		key, err := kubeConfigData(dir, user.ClientKey, user.ClientKeyData)
+		if err != nil {
+			return kubernetesConnection{}, "", maskAny(err)
+		}
+		config.ClientCert, config.ClientKey = cert, key
+		token := user.Token
+		if token == "" && user.TokenFile != "" {
+			raw, err := ioutil.ReadFile(resolveKubeConfigPath(dir, user.TokenFile))
+			if err != nil {
+				return kubernetesConnection{}, "", maskAny(err)
+			}
+			token = strings.TrimSpace(string(raw))
+		}
+		config.Token = token
+	}
+	conn, err := newKubernetesConnection(config)
+	if err != nil {
+		return kubernetesConnection{}, "", maskAny(errgo.WithCausef(nil, KubernetesError, "cannot create kubernetes client from kubeconfig %s: %s", kubeConfigPath, err))
+	}
+	namespace := context.Namespace
+	if namespace == "" {
+		namespace = defaultKubernetesNamespace
+	}
+	return conn, namespace, nil
+}
+
+// kubeConfigData returns the given base64 encoded data, or the content of the given file if data is empty.
+// It returns nil if both are empty.
+func kubeConfigData(dir, path, data string) ([]byte, error) {
+	if data != "" {
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "invalid base64 data in kubeconfig: %s", err))
+		}
+		return raw, nil
+	}
+	if path != "" {
+		raw, err := ioutil.ReadFile(resolveKubeConfigPath(dir, path))
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		return raw, nil
+	}
+	return nil, nil
+}
+
+// resolveKubeConfigPath resolves a path found in a kubeconfig file relative to the directory of that file.
+func resolveKubeConfigPath(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
@@ -20,13 +20,29 @@ import (
 	"strings"
 
 	k8s "github.com/YakLabs/k8s-client"
-	"github.com/YakLabs/k8s-client/http"
+	"github.com/juju/errgo"
+	"github.com/op/go-logging"
 )
 
+// KubernetesClientConfig holds the settings of a kubernetes client.
+type KubernetesClientConfig struct {
+	KubeConfigPath        string // If set, the client is created from this kubeconfig file instead of the in-cluster configuration
+	Context               string // Context of the kubeconfig file to use (defaults to its current context)
+	Namespace             string // If set, overrides the namespace of the pod (or kubeconfig context)
+	NodeName              string // Name of the node the current pod runs on
+	PodName               string // Name of the current pod
+	PodIP                 string // IP address of the current pod (used with hostNetwork=true)
+	ClusterInfoSecretName string // Name of the secret that holds the cluster ID
+	ClusterIDSecretKey    string // Key of the cluster ID in the cluster info secret
+}
+
 type K8sClient struct {
 	baseServerLoginData
+	log                   *logging.Logger
 	c                     k8s.Client
+	conn                  kubernetesConnection // Used for requests the k8s-client does not support
 	namespace             string
+	nodeName              string
 	podName               string
 	podIP                 string
 	clusterInfoSecretName string
@@ -34,23 +50,48 @@ type K8sClient struct {
 }
 
 // NewKubernetesClient creates a kubernetes client.
-func NewKubernetesClient(podName, podIP, clusterInfoSecretName, clusterIDSecretKey string) (*K8sClient, error) {
-	namespace, err := getKubernetesNamespace()
-	if err != nil {
-		return nil, maskAny(err)
+// When a kubeconfig path is given, the client is created from that file, otherwise
+// the in-cluster configuration is used.
+func NewKubernetesClient(log *logging.Logger, config KubernetesClientConfig) (*K8sClient, error) {
+	var conn kubernetesConnection
+	var namespace string
+	if config.KubeConfigPath != "" {
+		var err error
+		log.Debugf("Loading kubernetes configuration from %s", config.KubeConfigPath)
+		conn, namespace, err = newKubeConfigConnection(config.KubeConfigPath, config.Context)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+	} else {
+		var err error
+		if config.Namespace == "" {
+			namespace, err = getKubernetesNamespace()
+			if err != nil {
+				return nil, maskAny(err)
+			}
+		}
+		conn, err = newInClusterKubernetesConnection()
+		if err != nil {
+			return nil, maskAny(err)
+		}
 	}
-
-	client, err := http.NewInCluster()
+	if config.Namespace != "" {
+		namespace = config.Namespace
+	}
+	client, err := conn.newClient()
 	if err != nil {
 		return nil, maskAny(err)
 	}
 	return &K8sClient{
-		c:         client,
-		namespace: namespace,
-		podName:   podName,
-		podIP:     podIP,
-		clusterInfoSecretName: clusterInfoSecretName,
-		clusterIDSecretKey:    clusterIDSecretKey,
+		log:                   log,
+		c:                     client,
+		conn:                  conn,
+		namespace:             namespace,
+		nodeName:              config.NodeName,
+		podName:               config.PodName,
+		podIP:                 config.PodIP,
+		clusterInfoSecretName: config.ClusterInfoSecretName,
+		clusterIDSecretKey:    config.ClusterIDSecretKey,
 	}, nil
 }
 
@@ -68,12 +109,12 @@ func (c *K8sClient) ClusterID() (string, error) {
 	if c.clusterInfoSecretName != "" && c.clusterIDSecretKey != "" {
 		s, err := c.getKubernetesSecret(c.clusterInfoSecretName)
 		if err != nil {
-			fmt.Printf("ClusterInfo secret with name '%s' not found %#v\n", c.clusterInfoSecretName, err)
+			c.log.Warningf("Cannot get cluster info secret '%s', falling back: %s", c.clusterInfoSecretName, Describe(err))
 			// Now fallback to next
 		} else {
 			v, found := s.Data[c.clusterIDSecretKey]
 			if !found {
-				return "", maskAny(fmt.Errorf("Key '%s' is not found in secret '%s'", c.clusterIDSecretKey, c.clusterInfoSecretName))
+				return "", maskAny(errgo.WithCausef(nil, KubernetesError, "key '%s' is not found in secret '%s'", c.clusterIDSecretKey, c.clusterInfoSecretName))
 			}
 			return string(v), nil
 		}
@@ -81,53 +122,97 @@ func (c *K8sClient) ClusterID() (string, error) {
 	return c.baseServerLoginData.ClusterID()
 }
 
+// MachineID returns the machine ID of the node the current pod runs on.
+// The node is found by (in order) its name, the node name of the current pod or
+// the host IP of the current pod (or the pod IP when hostNetwork=true).
+// Only the last strategy needs to list all nodes.
 func (c *K8sClient) MachineID() (string, error) {
-	if c.podName != "" || c.podIP != "" {
-		var hostIP string
-		if c.podName != "" {
-			if pod, err := c.c.GetPod(c.namespace, c.podName); err == nil {
-				hostIP = pod.Status.HostIP
-			}
+	var failures []string
+	if c.nodeName != "" {
+		id, err := c.nodeMachineID(c.nodeName)
+		if err == nil {
+			return id, nil
 		}
-		if hostIP == "" {
-			// This is the case then hostNetwork=true
-			hostIP = c.podIP
-		}
-		if hostIP != "" {
-			nodes, err := c.c.ListNodes(nil)
-			if err != nil {
-				return "", maskAny(err)
-			}
-			// Check by address
-			for _, n := range nodes.Items {
-				for _, a := range n.Status.Addresses {
-					fmt.Printf("Checking node '%s' with address '%s', searching for '%s'\n", n.Spec.ExternalID, a.Address, hostIP)
-					if a.Address == hostIP {
-						nodeInfo := n.Status.NodeInfo
-						id := nodeInfo.MachineID
-						if id == "" {
-							id = nodeInfo.SystemUUID
-						}
-						return id, nil
-					}
+		c.log.Warningf("Cannot get machine ID of node '%s': %s", c.nodeName, Describe(err))
+		failures = append(failures, fmt.Sprintf("by node name '%s': %s", c.nodeName, err))
+	}
+	var hostIP string
+	if c.podName != "" {
+		pod, err := c.c.GetPod(c.namespace, c.podName)
+		if err != nil {
+			c.log.Warningf("Cannot get pod '%s': %s", c.podName, Describe(err))
+			failures = append(failures, fmt.Sprintf("by pod '%s': %s", c.podName, err))
+		} else {
+			if pod.Spec.NodeName != "" {
+				id, err := c.nodeMachineID(pod.Spec.NodeName)
+				if err == nil {
+					return id, nil
 				}
+				c.log.Warningf("Cannot get machine ID of node '%s' of pod '%s': %s", pod.Spec.NodeName, c.podName, Describe(err))
+				failures = append(failures, fmt.Sprintf("by node '%s' of pod '%s': %s", pod.Spec.NodeName, c.podName, err))
 			}
-			// Check by node name
-			if c.podName != "" {
-				for _, n := range nodes.Items {
-					if n.Spec.ExternalID == c.podName {
-						nodeInfo := n.Status.NodeInfo
-						id := nodeInfo.MachineID
-						if id == "" {
-							id = nodeInfo.SystemUUID
-						}
-						return id, nil
-					}
-				}
+			hostIP = pod.Status.HostIP
+		}
+	}
+	if hostIP == "" {
+		// The pod IP only equals the host IP when hostNetwork=true
+		hostIP = c.podIP
+	}
+	if hostIP != "" {
+		id, err := c.nodeMachineIDByAddress(hostIP)
+		if err == nil {
+			return id, nil
+		}
+		c.log.Warningf("Cannot find machine ID of node with address '%s': %s", hostIP, Describe(err))
+		failures = append(failures, fmt.Sprintf("by node address '%s': %s", hostIP, err))
+	}
+	id, err := c.baseServerLoginData.MachineID()
+	if err != nil {
+		if len(failures) > 0 {
+			return "", maskAny(errgo.WithCausef(nil, KubernetesError, "cannot find machine ID %s; %s", strings.Join(failures, "; "), err))
+		}
+		return "", maskAny(err)
+	}
+	return id, nil
+}
+
+// nodeMachineID fetches the node with given name and returns its machine ID.
+func (c *K8sClient) nodeMachineID(nodeName string) (string, error) {
+	node, err := c.c.GetNode(nodeName)
+	if err != nil {
+		return "", maskAny(err)
+	}
+	return machineIDOf(*node)
+}
+
+// nodeMachineIDByAddress lists all nodes and returns the machine ID of the node with given address.
+func (c *K8sClient) nodeMachineIDByAddress(address string) (string, error) {
+	nodes, err := c.c.ListNodes(nil)
+	if err != nil {
+		return "", maskAny(err)
+	}
+	for _, n := range nodes.Items {
+		for _, a := range n.Status.Addresses {
+			if a.Address == address {
+				c.log.Debugf("Found node '%s' with address '%s'", n.Name, address)
+				return machineIDOf(n)
 			}
 		}
 	}
-	return c.baseServerLoginData.MachineID()
+	return "", maskAny(errgo.WithCausef(nil, KubernetesError, "no node has address '%s'", address))
+}
+
+// machineIDOf returns the machine ID (or system UUID) of the given node.
+func machineIDOf(node k8s.Node) (string, error) {
+	nodeInfo := node.Status.NodeInfo
+	id := nodeInfo.MachineID
+	if id == "" {
+		id = nodeInfo.SystemUUID
+	}
+	if id == "" {
+		return "", maskAny(errgo.WithCausef(nil, KubernetesError, "node '%s' has no machine ID", node.Name))
+	}
+	return id, nil
 }
 
 // getKubernetesNamespace reads the namespace of the current pod from the well known location.
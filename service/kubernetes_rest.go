@@ -0,0 +1,189 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	nethttp "net/http"
+	"os"
+	"strings"
+
+	k8s "github.com/YakLabs/k8s-client"
+	"github.com/YakLabs/k8s-client/http"
+	"github.com/juju/errgo"
+)
+
+const (
+	k8sInClusterTokenFile        = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	k8sInClusterCAFile           = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	k8sStrategicMergePatch       = "application/strategic-merge-patch+json"
+	k8sJSONContentType           = "application/json"
+	k8sCoreAPIPathPrefix         = "/api/v1/namespaces/"
+	k8sAppsAPIPathPrefix         = "/apis/apps/v1/namespaces/"
+	k8sAuthorizationHeader       = "Authorization"
+	k8sBearerAuthorizationPrefix = "Bearer "
+)
+
+// kubernetesConnectionConfig holds the settings needed to connect to a kubernetes API server.
+type kubernetesConnectionConfig struct {
+	Server             string
+	CA                 []byte // PEM encoded CA certificate(s) used to verify the server (optional)
+	InsecureSkipVerify bool
+	ClientCert         []byte // PEM encoded client certificate (optional)
+	ClientKey          []byte // PEM encoded client key (optional)
+	Token              string // Bearer token (optional)
+}
+
+// kubernetesConnection holds the server & authenticated HTTP client used to talk to a kubernetes API server.
+// The HTTP client is shared by the k8s-client (for all typed requests) and by requests for
+// resources & fields the k8s-client does not support (e.g. owner references or config map binary data).
+type kubernetesConnection struct {
+	server string
+	client *nethttp.Client
+}
+
+// newKubernetesConnection creates a connection using the given settings.
+func newKubernetesConnection(config kubernetesConnectionConfig) (kubernetesConnection, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CA != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(config.CA) {
+			return kubernetesConnection{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot parse kubernetes CA certificate"))
+		}
+	}
+	if config.ClientCert != nil && config.ClientKey != nil {
+		cert, err := tls.X509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return kubernetesConnection{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot load kubernetes client certificate: %s", err))
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	var transport nethttp.RoundTripper = &nethttp.Transport{
+		Proxy:           nethttp.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	if config.Token != "" {
+		transport = &kubernetesTokenTransport{token: config.Token, next: transport}
+	}
+	return kubernetesConnection{
+		server: strings.TrimSuffix(config.Server, "/"),
+		client: &nethttp.Client{Transport: transport},
+	}, nil
+}
+
+// newInClusterKubernetesConnection creates a connection using the service account of the pod.
+func newInClusterKubernetesConnection() (kubernetesConnection, error) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return kubernetesConnection{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set"))
+	}
+	token, err := ioutil.ReadFile(k8sInClusterTokenFile)
+	if err != nil {
+		return kubernetesConnection{}, maskAny(err)
+	}
+	ca, err := ioutil.ReadFile(k8sInClusterCAFile)
+	if err != nil {
+		return kubernetesConnection{}, maskAny(err)
+	}
+	conn, err := newKubernetesConnection(kubernetesConnectionConfig{
+		Server: fmt.Sprintf("https://%s:%s", host, port),
+		CA:     ca,
+		Token:  strings.TrimSpace(string(token)),
+	})
+	if err != nil {
+		return kubernetesConnection{}, maskAny(err)
+	}
+	return conn, nil
+}
+
+// newClient creates a k8s-client that uses this connection.
+func (c kubernetesConnection) newClient() (*http.Client, error) {
+	client, err := http.New(http.SetServer(c.server), http.SetClient(c.client))
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return client, nil
+}
+
+// do sends a request with given method & (JSON encoded) input to the given API path and decodes
+// the response into the given output.
+// Failures are returned as *k8s.Status, just like the k8s-client does.
+func (c kubernetesConnection) do(method, path, contentType string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return maskAny(err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := nethttp.NewRequest(method, c.server+path, body)
+	if err != nil {
+		return maskAny(err)
+	}
+	req.Header.Set("Accept", k8sJSONContentType)
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return maskAny(err)
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return maskAny(err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		status := &k8s.Status{}
+		if err := json.Unmarshal(raw, status); err != nil || status.Code == 0 {
+			status.Code = int32(resp.StatusCode)
+		}
+		if status.Message == "" {
+			status.Message = fmt.Sprintf("%s %s failed with status %d", method, path, resp.StatusCode)
+		}
+		return maskAny(status)
+	}
+	if out != nil {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// kubernetesTokenTransport adds a bearer token to every request.
+type kubernetesTokenTransport struct {
+	token string
+	next  nethttp.RoundTripper
+}
+
+// RoundTrip sends the given request with the bearer token set.
+func (t *kubernetesTokenTransport) RoundTrip(req *nethttp.Request) (*nethttp.Response, error) {
+	clone := *req
+	clone.Header = make(nethttp.Header, len(req.Header))
+	for k, v := range req.Header {
+		clone.Header[k] = v
+	}
+	clone.Header.Set(k8sAuthorizationHeader, k8sBearerAuthorizationPrefix+t.token)
+	return t.next.RoundTrip(&clone)
+}
@@ -0,0 +1,213 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/juju/errgo"
+)
+
+const (
+	// secretVersionSeparator separates a secret path from a pinned version (path@version).
+	secretVersionSeparator = "@"
+	// kvMountInfoPath is the path used to detect the mount (and KV version) of a path.
+	kvMountInfoPath  = "sys/internal/ui/mounts/"
+	kvDataPrefix     = "data/"
+	kvMetadataPrefix = "metadata/"
+)
+
+// kvClient reads & writes secrets in KV mounts, translating paths for KV version 2 mounts.
+// Paths are always given in KV version 1 style (e.g. secret/foo), for version 2 mounts they
+// are translated into secret/data/foo (read, write) or secret/metadata/foo (list).
+type kvClient struct {
+	vaultClient *api.Client
+	mutex       sync.Mutex
+	mounts      map[string]int // Mount path -> KV version
+	legacy      bool           // Set if vault does not support mount detection (KV version 2 is not supported either)
+}
+
+// newKVClient creates a new kvClient for the given vault client.
+func newKVClient(vaultClient *api.Client) *kvClient {
+	return &kvClient{
+		vaultClient: vaultClient,
+		mounts:      make(map[string]int),
+	}
+}
+
+// splitSecretVersion splits a '<path>[@<version>]' secret path into a path and a version.
+// A version of 0 means the latest version.
+// Only a numeric suffix is considered a version, other '@' characters are part of the path.
+func splitSecretVersion(secretPath string) (string, int) {
+	idx := strings.LastIndex(secretPath, secretVersionSeparator)
+	if idx < 0 {
+		return secretPath, 0
+	}
+	version, err := strconv.Atoi(secretPath[idx+1:])
+	if err != nil || version <= 0 {
+		return secretPath, 0
+	}
+	return secretPath[:idx], version
+}
+
+// read reads the secret at the given path.
+// A version other than 0 reads that specific version, which is only supported by KV version 2 mounts.
+// It returns nil if there is no such secret.
+func (c *kvClient) read(secretPath string, version int) (*api.Secret, error) {
+	mount, kvVersion, err := c.mountOf(secretPath)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if kvVersion < 2 {
+		if version != 0 {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot read version %d of %s, versions are only supported by KV version 2", version, secretPath))
+		}
+		secret, err := c.vaultClient.Logical().Read(secretPath)
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		return secret, nil
+	}
+
+	// KV version 2
+	r := c.vaultClient.NewRequest("GET", "/v1/"+kvPath(mount, secretPath, kvDataPrefix))
+	if version != 0 {
+		r.Params.Set("version", strconv.Itoa(version))
+	}
+	resp, err := c.vaultClient.RawRequest(r)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if resp != nil && resp.StatusCode == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	secret, err := api.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	data, _ := secret.Data["data"].(map[string]interface{})
+	if data == nil {
+		// Version has been deleted
+		return nil, nil
+	}
+	secret.Data = data
+	return secret, nil
+}
+
+// write writes the given data into the secret at the given path.
+func (c *kvClient) write(secretPath string, data map[string]interface{}) error {
+	mount, kvVersion, err := c.mountOf(secretPath)
+	if err != nil {
+		return maskAny(err)
+	}
+	if kvVersion < 2 {
+		if _, err := c.vaultClient.Logical().Write(secretPath, data); err != nil {
+			return maskAny(err)
+		}
+		return nil
+	}
+	wrapped := map[string]interface{}{"data": data}
+	if _, err := c.vaultClient.Logical().Write(kvPath(mount, secretPath, kvDataPrefix), wrapped); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// list lists the keys under the given path.
+// It returns nil if there are no such keys.
+func (c *kvClient) list(secretPath string) (*api.Secret, error) {
+	mount, kvVersion, err := c.mountOf(secretPath)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	if kvVersion >= 2 {
+		secretPath = kvPath(mount, secretPath, kvMetadataPrefix)
+	}
+	secret, err := c.vaultClient.Logical().List(secretPath)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	return secret, nil
+}
+
+// policyPath returns the path that must be used in a policy to access the secrets at the given path.
+func (c *kvClient) policyPath(secretPath string) (string, error) {
+	mount, kvVersion, err := c.mountOf(secretPath)
+	if err != nil {
+		return "", maskAny(err)
+	}
+	if kvVersion >= 2 {
+		return kvPath(mount, secretPath, kvDataPrefix), nil
+	}
+	return secretPath, nil
+}
+
+// mountOf returns the mount path and KV version of the mount containing the given path.
+// For mounts that are not KV mounts, or when vault does not support mount detection, version 1 is returned.
+func (c *kvClient) mountOf(secretPath string) (string, int, error) {
+	secretPath = strings.TrimPrefix(secretPath, "/")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.legacy {
+		return "", 1, nil
+	}
+	for mount, version := range c.mounts {
+		if strings.HasPrefix(secretPath, mount) {
+			return mount, version, nil
+		}
+	}
+
+	info, err := c.vaultClient.Logical().Read(kvMountInfoPath + secretPath)
+	if err != nil {
+		return "", 0, maskAny(errgo.WithCausef(nil, VaultError, "cannot detect mount of %s: %s", secretPath, err))
+	}
+	if info == nil || info.Data == nil {
+		// Older vault, which only supports KV version 1
+		c.legacy = true
+		return "", 1, nil
+	}
+	mount, _ := info.Data["path"].(string)
+	version := 1
+	if kind, _ := info.Data["type"].(string); kind == "kv" {
+		if options, ok := info.Data["options"].(map[string]interface{}); ok {
+			if v, ok := options["version"].(string); ok && v == "2" {
+				version = 2
+			}
+		}
+	}
+	if mount != "" {
+		c.mounts[mount] = version
+	}
+	return mount, version, nil
+}
+
+// kvPath inserts the given prefix (data/ or metadata/) after the mount in the given path.
+// Paths that already contain the prefix are returned as is.
+func kvPath(mount, secretPath, prefix string) string {
+	rest := strings.TrimPrefix(strings.TrimPrefix(secretPath, "/"), mount)
+	if strings.HasPrefix(rest, prefix) {
+		return mount + rest
+	}
+	return mount + prefix + rest
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+)
+
+const (
+	// leaseReissueFraction determines when a dynamic secret is re-issued.
+	// Once the remaining TTL of its lease drops below this fraction of the original lease duration,
+	// the secret is read again (resulting in new credentials).
+	leaseReissueFraction = 3
+)
+
+// leaseCache holds the secrets with a lease (dynamic secrets, e.g. database credentials)
+// that have been read by a client.
+// Reading the same dynamic secret twice results in different credentials, so these secrets
+// are cached until they have to be re-issued.
+// Secrets that have to be re-issued are retired, until their replacement has been written.
+type leaseCache struct {
+	mutex   sync.Mutex
+	secrets map[string]*leasedSecret
+	retired []*leasedSecret
+}
+
+type leasedSecret struct {
+	path     string
+	secret   *api.Secret
+	duration time.Duration // Lease duration when the secret was issued
+	expires  time.Time     // Time the lease expires
+}
+
+func newLeaseCache() *leaseCache {
+	return &leaseCache{secrets: make(map[string]*leasedSecret)}
+}
+
+// get returns the cached secret for the given path, or nil if no valid secret is cached.
+func (lc *leaseCache) get(secretPath string) *api.Secret {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	if ls, found := lc.secrets[secretPath]; found && !ls.needsReissue() {
+		return ls.secret
+	}
+	return nil
+}
+
+// add stores the given secret in the cache if it has a lease.
+func (lc *leaseCache) add(secretPath string, secret *api.Secret) {
+	if secret.LeaseID == "" {
+		return
+	}
+	duration := time.Duration(secret.LeaseDuration) * time.Second
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	lc.secrets[secretPath] = &leasedSecret{
+		path:     secretPath,
+		secret:   secret,
+		duration: duration,
+		expires:  time.Now().Add(duration),
+	}
+}
+
+// needsReissue returns true if the lease of the secret will expire soon.
+func (ls *leasedSecret) needsReissue() bool {
+	return time.Until(ls.expires) < ls.duration/leaseReissueFraction
+}
+
+// hasLeases returns true if the cache holds any secret with a lease.
+func (lc *leaseCache) hasLeases() bool {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+	return len(lc.secrets) > 0
+}
+
+// RenewLeases renews the leases of all dynamic secrets read by this client.
+// Secrets whose lease can no longer be renewed long enough are retired, such that the next extraction
+// re-issues them. Call RevokeRetiredLeases once the re-issued secrets have been written.
+// It returns the time until the first secret has to be renewed or re-issued (0 if there are no leases).
+func (c *AuthenticatedVaultClient) RenewLeases() time.Duration {
+	return c.renewLeases(true)
+}
+
+// renewLeases renews the leases of all dynamic secrets read by this client.
+// If reissue is set, secrets whose lease can no longer be renewed long enough are retired.
+// Otherwise the leases are renewed until they expire.
+// It returns the time until the first secret has to be renewed or re-issued (0 if there are no leases).
+func (c *AuthenticatedVaultClient) renewLeases(reissue bool) time.Duration {
+	c.leases.mutex.Lock()
+	defer c.leases.mutex.Unlock()
+
+	var next time.Duration
+	for secretPath, ls := range c.leases.secrets {
+		if ls.secret.Renewable {
+			secret, err := c.vaultClient.Sys().Renew(ls.secret.LeaseID, 0)
+			if err != nil {
+				c.log.Warningf("Failed to renew lease of %s: %s", secretPath, Describe(err))
+			} else if secret != nil {
+				ls.expires = time.Now().Add(time.Duration(secret.LeaseDuration) * time.Second)
+				c.log.Debugf("Renewed lease of %s, expires in %s", secretPath, time.Until(ls.expires))
+			}
+		}
+		var threshold time.Duration
+		if reissue {
+			if ls.needsReissue() {
+				c.log.Infof("Lease of %s expires in %s, re-issuing", secretPath, time.Until(ls.expires))
+				delete(c.leases.secrets, secretPath)
+				c.leases.retired = append(c.leases.retired, ls)
+				// The secret will be re-issued immediately, so its next renewal is in the same order.
+				if d := ls.duration / leaseReissueFraction; next == 0 || d < next {
+					next = d
+				}
+				continue
+			}
+			threshold = ls.duration / leaseReissueFraction
+		} else if time.Until(ls.expires) <= 0 {
+			c.log.Warningf("Lease of %s has expired", secretPath)
+			delete(c.leases.secrets, secretPath)
+			continue
+		}
+		// Renew again before the re-issue threshold (or expiration) is reached
+		d := (time.Until(ls.expires) - threshold) / 2
+		if d < time.Second {
+			d = time.Second
+		}
+		if next == 0 || d < next {
+			next = d
+		}
+	}
+	return next
+}
+
+// RevokeRetiredLeases revokes the leases of all secrets that have been re-issued.
+// Call this once the re-issued secrets have been written, since the retired credentials are no longer used.
+func (c *AuthenticatedVaultClient) RevokeRetiredLeases() {
+	c.leases.mutex.Lock()
+	defer c.leases.mutex.Unlock()
+	for _, ls := range c.leases.retired {
+		c.revokeLease(ls)
+	}
+	c.leases.retired = nil
+}
+
+// RevokeLeases revokes the leases of all dynamic secrets read by this client (including retired ones).
+func (c *AuthenticatedVaultClient) RevokeLeases() {
+	c.leases.mutex.Lock()
+	defer c.leases.mutex.Unlock()
+	for secretPath, ls := range c.leases.secrets {
+		c.revokeLease(ls)
+		delete(c.leases.secrets, secretPath)
+	}
+	for _, ls := range c.leases.retired {
+		c.revokeLease(ls)
+	}
+	c.leases.retired = nil
+}
+
+// revokeLease revokes the lease of the given secret. The caller must hold the lease cache lock.
+func (c *AuthenticatedVaultClient) revokeLease(ls *leasedSecret) {
+	if err := c.vaultClient.Sys().Revoke(ls.secret.LeaseID); err != nil {
+		c.log.Warningf("Failed to revoke lease of %s: %s", ls.path, Describe(err))
+	} else {
+		c.log.Infof("Revoked lease of %s", ls.path)
+	}
+}
@@ -0,0 +1,466 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/juju/errgo"
+)
+
+// Manifest describes many extraction targets that are fulfilled together.
+//
+// Example (HCL):
+//
+//	require_tmpfs = true
+//	env "/run/app.env" {
+//	  format = "systemd"
+//	  secrets {
+//	    DB_USER = "/secret/db#user"
+//	    "APP_*" = "/secret/app#*"
+//	  }
+//	}
+//	file "/run/tls.key" {
+//	  secret = "/secret/tls#key"
+//	  mode   = "0440"
+//	  group  = "nginx"
+//	  on_change = "systemctl reload nginx"
+//	}
+//	template "/run/app.conf" {
+//	  source = "/etc/app.conf.tmpl"
+//	}
+//	kubernetes_secret "app-secrets" {
+//	  secrets {
+//	    DB_PASSWORD = "/secret/db#password"
+//	  }
+//	}
+type Manifest struct {
+	// RequireTmpfs enforces that all files are written to tmpfs or ramfs, even when a target allows persistent storage.
+	RequireTmpfs bool `hcl:"require_tmpfs"`
+	// AllowPersistent allows all files to be written to a filesystem other than tmpfs or ramfs.
+	AllowPersistent bool `hcl:"allow_persistent"`
+
+	EnvFiles          []ManifestEnvFile          `hcl:"env"`
+	Files             []ManifestFile             `hcl:"file"`
+	Templates         []ManifestTemplate         `hcl:"template"`
+	KubernetesSecrets []ManifestKubernetesSecret `hcl:"kubernetes_secret"`
+}
+
+// ManifestFileOptions holds the options of all targets that create a file.
+type ManifestFileOptions struct {
+	Mode                string `hcl:"mode"`             // Octal mode of the file (defaults to 0400)
+	Owner               string `hcl:"owner"`            // Name or uid of the owner of the file
+	Group               string `hcl:"group"`            // Name or gid of the group of the file
+	AllowPersistent     bool   `hcl:"allow_persistent"` // If set, the file may be written to a filesystem other than tmpfs or ramfs
+	ManifestHookOptions `hcl:",squash"`
+}
+
+// ManifestHookOptions holds the options of a target that specify what to do after it has changed.
+type ManifestHookOptions struct {
+	OnChange string `hcl:"on_change"` // Command to run (using /bin/sh -c)
+	Signal   string `hcl:"signal"`    // Name of the signal to send to the process in PIDFile
+	PIDFile  string `hcl:"pidfile"`   // Path of a file containing the ID of the process to signal
+}
+
+// ManifestEnvFile describes an environment file target.
+type ManifestEnvFile struct {
+	Path                string            `hcl:",key"`
+	Format              string            `hcl:"format"`  // Name of the EnvFormat (defaults to plain)
+	Secrets             map[string]string `hcl:"secrets"` // Maps environment keys to '<path>[#<field>]'
+	Include             []string          `hcl:"include_fields"`
+	Exclude             []string          `hcl:"exclude_fields"`
+	ManifestFileOptions `hcl:",squash"`
+}
+
+// ManifestFile describes a target file containing a single secret.
+type ManifestFile struct {
+	Path                string `hcl:",key"`
+	Secret              string `hcl:"secret"` // '<path>[#<field>]'
+	ManifestFileOptions `hcl:",squash"`
+}
+
+// ManifestTemplate describes a target file rendered from a template.
+type ManifestTemplate struct {
+	Path                string `hcl:",key"`
+	Source              string `hcl:"source"` // Path of the Go text template
+	ManifestFileOptions `hcl:",squash"`
+}
+
+// ManifestKubernetesSecret describes a Kubernetes secret target.
+type ManifestKubernetesSecret struct {
+	Name                string            `hcl:",key"`
+	Secrets             map[string]string `hcl:"secrets"` // Maps secret keys to '<path>[#<field>]'
+	Include             []string          `hcl:"include_fields"`
+	Exclude             []string          `hcl:"exclude_fields"`
+	Type                string            `hcl:"type"`        // Type of the secret (defaults to Opaque)
+	Labels              map[string]string `hcl:"labels"`      // Labels added to the secret
+	Annotations         map[string]string `hcl:"annotations"` // Annotations added to the secret
+	Owner               string            `hcl:"owner"`       // pod|deployment
+	ManifestHookOptions `hcl:",squash"`
+}
+
+// LoadManifest reads and parses a manifest from the file with given path.
+func LoadManifest(path string) (*Manifest, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	m := &Manifest{}
+	if err := hcl.Decode(m, string(raw)); err != nil {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot parse %s: %s", path, err))
+	}
+	if err := m.Validate(); err != nil {
+		return nil, maskAny(err)
+	}
+	return m, nil
+}
+
+// Validate checks the manifest for errors.
+func (m *Manifest) Validate() error {
+	paths := make(map[string]struct{})
+	checkPath := func(path string) error {
+		if path == "" {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "target path not set"))
+		}
+		if _, found := paths[path]; found {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "duplicate target %s", path))
+		}
+		paths[path] = struct{}{}
+		return nil
+	}
+	for _, t := range m.EnvFiles {
+		if err := checkPath(t.Path); err != nil {
+			return maskAny(err)
+		}
+		if _, err := GetEnvFormat(t.Format); err != nil {
+			return maskAny(err)
+		}
+		if _, err := t.envSecrets(); err != nil {
+			return maskAny(err)
+		}
+		if err := m.validateFileOptions(t.ManifestFileOptions); err != nil {
+			return maskAny(err)
+		}
+	}
+	for _, t := range m.Files {
+		if err := checkPath(t.Path); err != nil {
+			return maskAny(err)
+		}
+		if _, err := t.fileSecret(); err != nil {
+			return maskAny(err)
+		}
+		if err := m.validateFileOptions(t.ManifestFileOptions); err != nil {
+			return maskAny(err)
+		}
+	}
+	for _, t := range m.Templates {
+		if err := checkPath(t.Path); err != nil {
+			return maskAny(err)
+		}
+		if t.Source == "" {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "source of template %s not set", t.Path))
+		}
+		if err := m.validateFileOptions(t.ManifestFileOptions); err != nil {
+			return maskAny(err)
+		}
+	}
+	names := make(map[string]struct{})
+	for _, t := range m.KubernetesSecrets {
+		if t.Name == "" {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "kubernetes secret name not set"))
+		}
+		if _, found := names[t.Name]; found {
+			return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "duplicate kubernetes secret %s", t.Name))
+		}
+		names[t.Name] = struct{}{}
+		if _, err := t.envSecrets(); err != nil {
+			return maskAny(err)
+		}
+		if err := t.options().Validate(); err != nil {
+			return maskAny(err)
+		}
+		if _, err := t.ManifestHookOptions.hook(); err != nil {
+			return maskAny(err)
+		}
+	}
+	return nil
+}
+
+// validateFileOptions checks the options of a file target for errors.
+func (m *Manifest) validateFileOptions(o ManifestFileOptions) error {
+	if err := m.fileOptions(o).Validate(); err != nil {
+		return maskAny(err)
+	}
+	if _, err := o.ManifestHookOptions.hook(); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// fileOptions returns the mode, ownership & storage options of a file target,
+// combined with the global settings of the manifest.
+func (m *Manifest) fileOptions(o ManifestFileOptions) FileOptions {
+	return FileOptions{
+		Mode:            o.Mode,
+		Owner:           o.Owner,
+		Group:           o.Group,
+		AllowPersistent: m.AllowPersistent || o.AllowPersistent,
+		RequireTmpfs:    m.RequireTmpfs,
+	}
+}
+
+// hook converts the hook options into a ChangeHook.
+func (o ManifestHookOptions) hook() (ChangeHook, error) {
+	hook := ChangeHook{
+		Command: o.OnChange,
+		PIDFile: o.PIDFile,
+	}
+	if o.Signal != "" {
+		if o.PIDFile == "" {
+			return ChangeHook{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "signal requires pidfile"))
+		}
+		sig, err := ParseSignal(o.Signal)
+		if err != nil {
+			return ChangeHook{}, maskAny(err)
+		}
+		hook.Signal = sig
+	} else if o.PIDFile != "" {
+		return ChangeHook{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "pidfile requires signal"))
+	}
+	return hook, nil
+}
+
+// envSecrets converts the secrets of an environment file target into EnvSecrets.
+func (t ManifestEnvFile) envSecrets() ([]EnvSecret, error) {
+	return parseManifestSecrets(t.Secrets, t.Include, t.Exclude)
+}
+
+// envSecrets converts the secrets of a Kubernetes secret target into EnvSecrets.
+func (t ManifestKubernetesSecret) envSecrets() ([]EnvSecret, error) {
+	return parseManifestSecrets(t.Secrets, t.Include, t.Exclude)
+}
+
+// options returns the options of a Kubernetes secret target.
+func (t ManifestKubernetesSecret) options() KubernetesSecretOptions {
+	return KubernetesSecretOptions{
+		Type:        t.Type,
+		Labels:      t.Labels,
+		Annotations: t.Annotations,
+		Owner:       t.Owner,
+	}
+}
+
+// fileSecret converts the secret of a file target into a FileSecret.
+func (t ManifestFile) fileSecret() (FileSecret, error) {
+	if t.Secret == "" {
+		return FileSecret{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "secret of file %s not set", t.Path))
+	}
+	secretPath, secretField, err := ParseSecretPath(t.Secret)
+	if err != nil {
+		return FileSecret{}, maskAny(err)
+	}
+	if secretField == WildcardField {
+		return FileSecret{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "extracting all fields (#*) is not supported for file %s", t.Path))
+	}
+	return FileSecret{SecretPath: secretPath, SecretField: secretField}, nil
+}
+
+// parseManifestSecrets converts a map of key -> '<path>[#<field>]' into EnvSecrets, sorted by key.
+func parseManifestSecrets(secrets map[string]string, include, exclude []string) ([]EnvSecret, error) {
+	if len(secrets) == 0 {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "no secrets specified"))
+	}
+	keys := make([]string, 0, len(secrets))
+	for key := range secrets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := []EnvSecret{}
+	for _, key := range keys {
+		secretPath, secretField, err := ParseSecretPath(secrets[key])
+		if err != nil {
+			return nil, maskAny(err)
+		}
+		secret := EnvSecret{
+			SecretPath:     secretPath,
+			SecretField:    secretField,
+			EnvironmentKey: key,
+		}
+		if secret.IsWildcard() {
+			secret.Include = include
+			secret.Exclude = exclude
+		}
+		if err := secret.Validate(); err != nil {
+			return nil, maskAny(err)
+		}
+		result = append(result, secret)
+	}
+	return result, nil
+}
+
+// manifestFile is a file that is written when applying a manifest.
+type manifestFile struct {
+	path    string
+	content []byte
+	options FileOptions
+	hook    ManifestHookOptions
+}
+
+// manifestKubernetesSecret is a Kubernetes secret that is updated when applying a manifest.
+type manifestKubernetesSecret struct {
+	name        string
+	vars        []EnvVar
+	options     KubernetesSecretOptions
+	sourcePaths []string
+	hook        ManifestHookOptions
+}
+
+// ApplyManifest extracts all secrets for all targets of the given manifest and writes the targets.
+// No target is written if extracting any of the secrets fails, or if any of the targets cannot be written
+// because of its storage (see FileOptions) or its existing Kubernetes secret (e.g. its type).
+// Once all targets are written, the hooks of all changed targets are run.
+// If writing a target fails anyway, the hooks of the targets written before are run and
+// true is returned together with an error that lists those targets.
+// The Kubernetes client is only needed when the manifest contains Kubernetes secrets.
+// It returns true if any target has been written.
+func (c *AuthenticatedVaultClient) ApplyManifest(m *Manifest, k8sClient *K8sClient) (bool, error) {
+	if err := m.Validate(); err != nil {
+		return false, maskAny(err)
+	}
+	if len(m.KubernetesSecrets) > 0 && k8sClient == nil {
+		return false, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "manifest contains kubernetes secrets, but not running in kubernetes"))
+	}
+
+	// Extract all secrets
+	files := []manifestFile{}
+	for _, t := range m.EnvFiles {
+		secrets, _ := t.envSecrets()
+		format, _ := GetEnvFormat(t.Format)
+		content, err := c.environmentFileContent(secrets, format)
+		if err != nil {
+			return false, maskAny(err)
+		}
+		files = append(files, manifestFile{path: t.Path, content: content, options: m.fileOptions(t.ManifestFileOptions), hook: t.ManifestHookOptions})
+	}
+	for _, t := range m.Files {
+		secret, _ := t.fileSecret()
+		content, err := c.secretFileContent(secret)
+		if err != nil {
+			return false, maskAny(err)
+		}
+		files = append(files, manifestFile{path: t.Path, content: content, options: m.fileOptions(t.ManifestFileOptions), hook: t.ManifestHookOptions})
+	}
+	for _, t := range m.Templates {
+		content, err := c.templateFileContent(t.Source)
+		if err != nil {
+			return false, maskAny(err)
+		}
+		files = append(files, manifestFile{path: t.Path, content: content, options: m.fileOptions(t.ManifestFileOptions), hook: t.ManifestHookOptions})
+	}
+	k8sSecrets := []manifestKubernetesSecret{}
+	for _, t := range m.KubernetesSecrets {
+		secrets, _ := t.envSecrets()
+		vars, err := c.extractKubernetesSecrets(secrets)
+		if err != nil {
+			return false, maskAny(err)
+		}
+		k8sSecrets = append(k8sSecrets, manifestKubernetesSecret{
+			name:        t.Name,
+			vars:        vars,
+			options:     t.options(),
+			sourcePaths: envSecretPaths(secrets),
+			hook:        t.ManifestHookOptions,
+		})
+	}
+
+	// Check all targets, so failures that can be detected up front do not leave some targets written
+	for _, f := range files {
+		if err := f.options.checkStorage(f.path); err != nil {
+			return false, maskAny(err)
+		}
+	}
+	for _, s := range k8sSecrets {
+		if err := k8sClient.checkKubernetesSecretData(s.name, s.vars, s.options, s.sourcePaths); err != nil {
+			return false, maskAny(err)
+		}
+	}
+
+	// Write all targets
+	hooks := []ManifestHookOptions{}
+	written := []string{}
+	// failed runs the hooks of the targets written before the given error occurred and returns that error,
+	// annotated with the written targets.
+	failed := func(err error) (bool, error) {
+		if len(written) == 0 {
+			return false, maskAny(err)
+		}
+		c.log.Errorf("Applying manifest failed after writing %s: %s", strings.Join(written, ", "), Describe(err))
+		for _, h := range hooks {
+			hook, _ := h.hook()
+			if hookErr := hook.Run(c.log); hookErr != nil {
+				c.log.Errorf("Hook failed: %s", Describe(hookErr))
+			}
+		}
+		return true, maskAny(errgo.WithCausef(nil, errgo.Cause(err), "%s (already written: %s)", err, strings.Join(written, ", ")))
+	}
+	for _, f := range files {
+		changed, err := f.write()
+		if err != nil {
+			return failed(err)
+		}
+		if changed {
+			c.log.Infof("Wrote %s", f.path)
+			hooks = append(hooks, f.hook)
+			written = append(written, f.path)
+		} else {
+			c.log.Infof("%s is up to date", f.path)
+		}
+	}
+	for _, s := range k8sSecrets {
+		changed, err := k8sClient.storeKubernetesSecretData(s.name, s.vars, s.options, s.sourcePaths)
+		if err != nil {
+			return failed(err)
+		}
+		if changed {
+			c.log.Infof("Updated kubernetes secret %s", s.name)
+			hooks = append(hooks, s.hook)
+			written = append(written, "kubernetes secret "+s.name)
+		} else {
+			c.log.Infof("Kubernetes secret %s is up to date", s.name)
+		}
+	}
+
+	// Run hooks of changed targets
+	for _, h := range hooks {
+		hook, _ := h.hook()
+		if err := hook.Run(c.log); err != nil {
+			return true, maskAny(err)
+		}
+	}
+	return len(hooks) > 0, nil
+}
+
+// write writes the content of the file, using its options.
+// It returns true if the content of the file has been written.
+func (f manifestFile) write() (bool, error) {
+	changed, err := writeFileIfChanged(f.path, f.content, f.options, defaultSecretFileMode)
+	if err != nil {
+		return false, maskAny(err)
+	}
+	return changed, nil
+}
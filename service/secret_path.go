@@ -0,0 +1,53 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"strings"
+
+	"github.com/juju/errgo"
+)
+
+// ParseSecretPath parses a '<path>[@<version>][#<field>]' argument into a secret path and field.
+// The field defaults to 'value'. A pinned version remains part of the returned path and is
+// resolved when the secret is read (KV version 2 mounts only).
+func ParseSecretPath(arg string) (string, string, error) {
+	pf := strings.Split(arg, "#")
+	switch len(pf) {
+	case 1:
+		return arg, defaultSecretField, nil
+	case 2:
+		return pf[0], pf[1], nil
+	default:
+		return "", "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "expected '<path>[#field]', got '%s'", arg))
+	}
+}
+
+// ParseEnvSecret parses a '<key>=<path>[#<field>]' argument into an EnvSecret.
+func ParseEnvSecret(arg string) (EnvSecret, error) {
+	kv := strings.Split(arg, "=")
+	if len(kv) != 2 {
+		return EnvSecret{}, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "expected '<key>=<path>[#field]', got '%s'", arg))
+	}
+	secretPath, secretField, err := ParseSecretPath(kv[1])
+	if err != nil {
+		return EnvSecret{}, maskAny(err)
+	}
+	return EnvSecret{
+		SecretPath:     secretPath,
+		SecretField:    secretField,
+		EnvironmentKey: kv[0],
+	}, nil
+}
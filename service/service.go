@@ -36,6 +36,12 @@ type VaultServiceConfig struct {
 	IPv6Only       bool   // If set, only use IPv6 addresses
 	DisableAppID   bool   // If set, AppID authentication is disabled
 	DisableAppRole bool   // If set, AppRole authentication is disabled
+	// Names of the login methods used for server logins, in the order in which they are attempted.
+	// If empty, kubernetes (if KubernetesAuthMount is set), approle & app-id are used.
+	AuthMethods []string
+	// If set, the first step of the server login is attempted using the kubernetes (or JWT) auth method mounted at this path
+	KubernetesAuthMount string
+	KubernetesJWTPath   string // Path of the service account token used for kubernetes authentication
 }
 
 type VaultService struct {
@@ -46,7 +52,7 @@ type VaultService struct {
 	certPool     *x509.CertPool
 	ipv4Only     bool // If set, only use IPv4 addresses
 	ipv6Only     bool // If set, only use IPv6 addresses
-	authMethods  AuthMethod
+	authMethods  []LoginMethod
 }
 
 type VaultClient struct {
@@ -94,12 +100,9 @@ func NewVaultService(log *logging.Logger, srvCfg VaultServiceConfig) (*VaultServ
 			return nil, maskAny(err)
 		}
 	}
-	var methods AuthMethod
-	if !srvCfg.DisableAppID {
-		methods = methods | AuthMethodAppID
-	}
-	if !srvCfg.DisableAppRole {
-		methods = methods | AuthMethodAppRole
+	methods, err := newLoginMethods(srvCfg)
+	if err != nil {
+		return nil, maskAny(err)
 	}
 
 	return &VaultService{
@@ -275,5 +278,7 @@ func (s *VaultService) newAuthenticatedClient(vaultClient *api.Client) *Authenti
 		log:         s.log,
 		vaultClient: vaultClient,
 		authMethods: s.authMethods,
+		leases:      newLeaseCache(),
+		kv:          newKVClient(vaultClient),
 	}
 }
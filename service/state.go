@@ -0,0 +1,252 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/juju/errgo"
+	"github.com/op/go-logging"
+)
+
+const (
+	// DefaultStateDir is the default directory of the state file.
+	DefaultStateDir = "/run/vault-monkey"
+	stateFileName   = "targets.json"
+)
+
+var (
+	stateDir     string
+	stateLog     *logging.Logger
+	processState State
+	processMutex sync.Mutex
+)
+
+// EnableStateFile enables recording all written targets in the state file in the given directory,
+// so they can be removed by Cleanup (e.g. from another process).
+// An error is returned (and recording stays disabled) when the directory cannot be used.
+// Recording is best effort; later failures are logged as warnings.
+// Without a state file, written targets are only recorded in memory (see CleanupWrittenTargets).
+func EnableStateFile(log *logging.Logger, dir string) error {
+	stateLog = log
+	stateDir = dir
+	if err := withStateLock(func() error { return nil }); err != nil {
+		stateDir = ""
+		return maskAny(err)
+	}
+	return nil
+}
+
+// State holds all targets written by vault-monkey, so they can be removed by Cleanup.
+type State struct {
+	Files                []string              `json:"files,omitempty"`                  // Absolute paths of written files
+	KubernetesSecrets    []StateKubernetesKeys `json:"kubernetes_secrets,omitempty"`     // Keys added to Kubernetes secrets
+	KubernetesConfigMaps []StateKubernetesKeys `json:"kubernetes_config_maps,omitempty"` // Keys added to Kubernetes config maps
+}
+
+// StateKubernetesKeys holds the keys added to a Kubernetes secret or config map.
+type StateKubernetesKeys struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Keys      []string `json:"keys"`
+}
+
+// IsEmpty returns true if the state contains no targets.
+func (s State) IsEmpty() bool {
+	return len(s.Files) == 0 && len(s.KubernetesSecrets) == 0 && len(s.KubernetesConfigMaps) == 0
+}
+
+// LoadState reads the state file.
+// A missing state file results in an empty state.
+func LoadState() (State, error) {
+	var result State
+	if stateDir == "" {
+		return result, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "no state directory set"))
+	}
+	if err := withStateLock(func() error {
+		var err error
+		result, err = readState()
+		return maskAny(err)
+	}); err != nil {
+		return State{}, maskAny(err)
+	}
+	return result, nil
+}
+
+// recordFile records the file with given path as written by this process.
+func recordFile(path string) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		absPath = path
+	}
+	recordTarget(func(s *State) bool {
+		return s.addFile(absPath)
+	})
+}
+
+// recordKubernetesSecretKeys records the given keys of the Kubernetes secret with given namespace & name
+// as added by this process.
+func recordKubernetesSecretKeys(namespace, name string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	recordTarget(func(s *State) bool {
+		var changed bool
+		s.KubernetesSecrets, changed = addKubernetesKeys(s.KubernetesSecrets, namespace, name, keys)
+		return changed
+	})
+}
+
+// recordKubernetesConfigMapKeys records the given keys of the Kubernetes config map with given namespace & name
+// as added by this process.
+func recordKubernetesConfigMapKeys(namespace, name string, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	recordTarget(func(s *State) bool {
+		var changed bool
+		s.KubernetesConfigMaps, changed = addKubernetesKeys(s.KubernetesConfigMaps, namespace, name, keys)
+		return changed
+	})
+}
+
+// recordTarget applies the given update to the in-memory state of this process and to the state file (if enabled).
+// A failure to update the state file is logged as a warning.
+func recordTarget(update func(s *State) bool) {
+	processMutex.Lock()
+	update(&processState)
+	processMutex.Unlock()
+	if err := updateState(update); err != nil && stateLog != nil {
+		stateLog.Warningf("Cannot record written target in state file in %s: %s", stateDir, Describe(err))
+	}
+}
+
+// addFile adds the given path to the recorded files.
+// It returns true if the path was not yet recorded.
+func (s *State) addFile(path string) bool {
+	for _, p := range s.Files {
+		if p == path {
+			return false
+		}
+	}
+	s.Files = append(s.Files, path)
+	sort.Strings(s.Files)
+	return true
+}
+
+// addKubernetesKeys adds the given keys of the object with given namespace & name to the given list.
+// It returns the updated list and true if any key was not yet recorded.
+func addKubernetesKeys(list []StateKubernetesKeys, namespace, name string, keys []string) ([]StateKubernetesKeys, bool) {
+	for i, entry := range list {
+		if entry.Namespace == namespace && entry.Name == name {
+			merged := mergeKeys(entry.Keys, keys)
+			if len(merged) == len(entry.Keys) {
+				return list, false
+			}
+			list[i].Keys = merged
+			return list, true
+		}
+	}
+	return append(list, StateKubernetesKeys{
+		Namespace: namespace,
+		Name:      name,
+		Keys:      mergeKeys(nil, keys),
+	}), true
+}
+
+// mergeKeys returns the sorted, unique union of the given keys.
+func mergeKeys(a, b []string) []string {
+	found := make(map[string]struct{})
+	result := []string{}
+	for _, k := range append(append([]string{}, a...), b...) {
+		if _, ok := found[k]; !ok {
+			found[k] = struct{}{}
+			result = append(result, k)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// updateState modifies the state file using the given function.
+// The state file is only written when the function returns true.
+// Without a state directory, nothing is done.
+func updateState(update func(s *State) bool) error {
+	if stateDir == "" {
+		return nil
+	}
+	if err := withStateLock(func() error {
+		s, err := readState()
+		if err != nil {
+			return maskAny(err)
+		}
+		if !update(&s) {
+			return nil
+		}
+		content, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return maskAny(err)
+		}
+		if err := writeFileAtomic(filepath.Join(stateDir, stateFileName), content, 0600, -1, -1); err != nil {
+			return maskAny(err)
+		}
+		return nil
+	}); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// readState reads the state file. The caller must hold the state lock.
+func readState() (State, error) {
+	var result State
+	raw, err := ioutil.ReadFile(filepath.Join(stateDir, stateFileName))
+	if os.IsNotExist(err) {
+		return result, nil
+	} else if err != nil {
+		return result, maskAny(err)
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return result, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot parse state file in %s: %s", stateDir, err))
+	}
+	return result, nil
+}
+
+// withStateLock runs the given function while holding an exclusive lock on the state file,
+// so multiple vault-monkey processes can safely record their targets.
+func withStateLock(fn func() error) error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot create state directory (use --state-dir to change it): %s", err))
+	}
+	f, err := os.OpenFile(filepath.Join(stateDir, stateFileName+".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return maskAny(err)
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return maskAny(err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	if err := fn(); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
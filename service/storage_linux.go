@@ -0,0 +1,49 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"syscall"
+
+	"github.com/juju/errgo"
+)
+
+const (
+	// Filesystem types as reported by statfs (see `man 2 statfs`)
+	tmpfsMagic int64 = 0x01021994
+	ramfsMagic int64 = 0x858458f6
+)
+
+// ensureNonPersistentStorage returns a PersistentStorageError when the file with given path
+// would not be stored on a tmpfs or ramfs filesystem.
+// The directory of the file does not have to exist yet, in which case its nearest existing parent is checked.
+func ensureNonPersistentStorage(path string) error {
+	dir := existingDirectoryOf(path)
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return maskAny(err)
+	}
+	// The type of Statfs_t.Type differs per architecture (int32 on 32-bit ones), so only use the lower 32 bits
+	fsType := int64(stat.Type) & 0xffffffff
+	switch fsType {
+	case tmpfsMagic, ramfsMagic:
+		return nil
+	default:
+		return maskAny(errgo.WithCausef(nil, PersistentStorageError, "%s is not on a tmpfs or ramfs filesystem (type 0x%x), use --allow-persistent to write it anyway", path, fsType))
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package service
+
+import (
+	"github.com/juju/errgo"
+)
+
+// ensureNonPersistentStorage returns a PersistentStorageError, since detecting non-persistent
+// storage is only supported on Linux.
+func ensureNonPersistentStorage(path string) error {
+	return maskAny(errgo.WithCausef(nil, PersistentStorageError, "cannot detect whether %s is on non-persistent storage on this platform, use --allow-persistent to write it anyway", path))
+}
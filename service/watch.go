@@ -0,0 +1,141 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+const (
+	// minTokenTTL is the minimum remaining TTL of a token that is still used by Watch.
+	// If the remaining TTL drops below this value, a new login is performed.
+	minTokenTTL = 30 * time.Second
+	// loginRetryInterval is the time between 2 failed login attempts in Watch.
+	loginRetryInterval = 10 * time.Second
+)
+
+// WatchTarget is implemented by all targets that can be kept up to date by Watch.
+type WatchTarget interface {
+	// Update extracts the secrets of this target and rewrites the target when its content has changed.
+	// It returns true if the target has been rewritten.
+	Update(c *AuthenticatedVaultClient) (bool, error)
+	// String returns a human readable description of the target.
+	String() string
+}
+
+// LoginFunc performs a login and returns the resulting authenticated client.
+type LoginFunc func() (*AuthenticatedVaultClient, error)
+
+// WatchConfig holds the settings of Watch.
+type WatchConfig struct {
+	Interval           time.Duration // Time between 2 updates of all targets
+	RevokeLeasesOnStop bool          // If set, the leases of all dynamic secrets are revoked when stopped
+}
+
+// Watch keeps all given targets up to date until the given stop channel is closed.
+// The token of the client is renewed before every update. When that is no longer possible,
+// a new login is performed using the given login function.
+// The leases of dynamic secrets are renewed as well. When a lease is about to expire,
+// the secret is re-issued and the targets using it are rewritten.
+// Leases that are replaced (by re-issuing a secret or by a new login) are revoked once
+// all targets have been rewritten.
+func Watch(log *logging.Logger, login LoginFunc, config WatchConfig, stop <-chan struct{}, targets ...WatchTarget) {
+	var c, old *AuthenticatedVaultClient
+	// retire replaces the current client. Its leases are revoked once the targets use the secrets of the new client.
+	retire := func() {
+		if old != nil {
+			old.RevokeLeases()
+		}
+		old = c
+		c = nil
+	}
+	for {
+		var ttl time.Duration
+		if c != nil {
+			// Keep the current token alive
+			var err error
+			ttl, err = c.RenewToken()
+			if err != nil {
+				log.Warningf("Token renewal failed, login again: %s", Describe(err))
+				retire()
+			} else if ttl > 0 && ttl < minTokenTTL {
+				log.Infof("Token expires in %s, login again", ttl)
+				retire()
+			}
+		}
+		if c == nil {
+			var err error
+			if c, err = login(); err != nil {
+				log.Errorf("Login failed: %s", Describe(err))
+				c = nil
+			} else if ttl, err = c.RenewToken(); err != nil {
+				log.Warningf("Cannot determine TTL of new token: %s", Describe(err))
+			}
+		}
+
+		wait := config.Interval
+		if c == nil {
+			if wait > loginRetryInterval {
+				wait = loginRetryInterval
+			}
+		} else {
+			// Renew leases of dynamic secrets
+			if leaseTTL := c.RenewLeases(); leaseTTL > 0 && leaseTTL < wait {
+				wait = leaseTTL
+			}
+			// Update all targets
+			failed := false
+			for _, t := range targets {
+				if changed, err := t.Update(c); err != nil {
+					log.Errorf("Failed to update %s: %s", t, Describe(err))
+					failed = true
+				} else if changed {
+					log.Infof("Updated %s", t)
+				} else {
+					log.Debugf("%s is up to date", t)
+				}
+			}
+			if !failed {
+				// All targets use the current secrets, replaced leases are no longer needed
+				c.RevokeRetiredLeases()
+				if old != nil {
+					old.RevokeLeases()
+					old = nil
+				}
+			}
+			if ttl > 0 && ttl/2 < wait {
+				// Renew the token before it expires
+				wait = ttl / 2
+			}
+		}
+
+		select {
+		case <-stop:
+			if config.RevokeLeasesOnStop {
+				if c != nil {
+					c.RevokeLeases()
+				}
+				if old != nil {
+					old.RevokeLeases()
+				}
+			}
+			return
+		case <-time.After(wait):
+			// Continue
+		}
+	}
+}
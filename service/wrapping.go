@@ -0,0 +1,195 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"sort"
+
+	"github.com/giantswarm/retry-go"
+	"github.com/hashicorp/vault/api"
+	"github.com/juju/errgo"
+)
+
+const (
+	wrapPath = "sys/wrapping/wrap"
+	// wrappedTokenField is the field that holds the token of an unwrapped authentication response
+	// (e.g. created by `token create --wrap-ttl`).
+	wrappedTokenField = "token"
+)
+
+// CreateWrappedEnvironmentFile extracts one or more secrets, wraps their keys & values
+// in a single use wrapping token with given TTL and creates a file containing that token.
+// The secrets can be written into an environment file using `unwrap env`.
+func (c *AuthenticatedVaultClient) CreateWrappedEnvironmentFile(path string, secrets []EnvSecret, wrapTTL string, options FileOptions) error {
+	vars, err := c.extractEnvSecrets(secrets)
+	if err != nil {
+		return maskAny(err)
+	}
+	data := make(map[string]interface{})
+	for _, v := range vars {
+		data[v.Key] = v.Value
+	}
+	if err := c.createWrappingTokenFile(path, data, wrapTTL, options); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// CreateWrappedSecretFile extracts one secret, wraps its value in a single use wrapping token
+// with given TTL and creates a file containing that token.
+// The secret can be written into a file using `unwrap file`.
+func (c *AuthenticatedVaultClient) CreateWrappedSecretFile(path string, secret FileSecret, wrapTTL string, options FileOptions) error {
+	value, err := c.secretFileContent(secret)
+	if err != nil {
+		return maskAny(err)
+	}
+	data := map[string]interface{}{
+		defaultSecretField: string(value),
+	}
+	if err := c.createWrappingTokenFile(path, data, wrapTTL, options); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// createWrappingTokenFile wraps the given data and creates a file containing the wrapping token.
+func (c *AuthenticatedVaultClient) createWrappingTokenFile(path string, data map[string]interface{}, wrapTTL string, options FileOptions) error {
+	token, err := c.wrapData(data, wrapTTL)
+	if err != nil {
+		return maskAny(err)
+	}
+	if err := writeSecretFile(path, []byte(token), options); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// wrapData wraps the given data in a single use wrapping token with given TTL.
+func (c *AuthenticatedVaultClient) wrapData(data map[string]interface{}, wrapTTL string) (string, error) {
+	if wrapTTL == "" {
+		return "", maskAny(errgo.WithCausef(nil, InvalidArgumentError, "wrap TTL not set"))
+	}
+	// Only wrap the response of the wrap request, the client can be used for other requests.
+	c.vaultClient.SetWrappingLookupFunc(func(operation, path string) string {
+		if path == wrapPath {
+			return wrapTTL
+		}
+		return ""
+	})
+	defer c.vaultClient.SetWrappingLookupFunc(nil)
+
+	var token string
+	op := func() error {
+		secret, err := c.vaultClient.Logical().Write(wrapPath, data)
+		if err != nil {
+			return maskAny(errgo.WithCausef(nil, VaultError, "error wrapping secret: %s", err))
+		}
+		if secret == nil || secret.WrapInfo == nil || secret.WrapInfo.Token == "" {
+			return maskAny(errgo.WithCausef(nil, VaultError, "missing wrapping token in response"))
+		}
+		token = secret.WrapInfo.Token
+		return nil
+	}
+	if err := retry.Do(op, retry.RetryChecker(IsVault), retry.MaxTries(3)); err != nil {
+		return "", maskAny(err)
+	}
+	return token, nil
+}
+
+// UnwrappedSecret holds the fields of an unwrapped secret.
+type UnwrappedSecret map[string]string
+
+// Unwrap unwraps the secret wrapped in given single use wrapping token.
+// No login is needed, the wrapping token itself is used.
+// When the wrapped response contains a token (e.g. created by `token create --wrap-ttl`),
+// it is available in the 'token' field.
+func (s *VaultService) Unwrap(wrappingToken string) (UnwrappedSecret, error) {
+	if wrappingToken == "" {
+		return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "wrapping token not set"))
+	}
+	vaultClient, _, err := s.newUnsealedClient()
+	if err != nil {
+		return nil, maskAny(err)
+	}
+	// Wrapping tokens are single use, so do not retry.
+	secret, err := vaultClient.Logical().Unwrap(wrappingToken)
+	if err != nil {
+		return nil, maskAny(errgo.WithCausef(nil, VaultError, "error unwrapping: %s", err))
+	}
+	if secret == nil {
+		return nil, maskAny(errgo.WithCausef(nil, SecretNotFoundError, "nothing found for wrapping token, it may have expired or has already been used"))
+	}
+	return unwrappedSecretFrom(secret)
+}
+
+// unwrappedSecretFrom converts the fields of the given secret into an UnwrappedSecret.
+func unwrappedSecretFrom(secret *api.Secret) (UnwrappedSecret, error) {
+	result := make(UnwrappedSecret)
+	for field, raw := range secret.Data {
+		value, err := formatSecretValue(raw)
+		if err != nil {
+			return nil, maskAny(errgo.WithCausef(nil, InvalidArgumentError, "cannot format field '%s': %s", field, err))
+		}
+		result[field] = value
+	}
+	if secret.Auth != nil && secret.Auth.ClientToken != "" {
+		result[wrappedTokenField] = secret.Auth.ClientToken
+	}
+	return result, nil
+}
+
+// CreateEnvironmentFile creates an environment file containing all fields of the secret,
+// formatted in the given format (nil results in the default format).
+func (s UnwrappedSecret) CreateEnvironmentFile(path string, format EnvFormat, options FileOptions) error {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	vars := []EnvVar{}
+	for _, key := range keys {
+		vars = append(vars, EnvVar{Key: key, Value: s[key]})
+	}
+	content, err := formatEnvVars(vars, format)
+	if err != nil {
+		return maskAny(err)
+	}
+	if err := writeSecretFile(path, content, options); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
+
+// CreateSecretFile creates a file containing the value of the given field of the secret.
+// If the field is empty, the 'value' field is used, or the only field when the secret has a single field.
+func (s UnwrappedSecret) CreateSecretFile(path string, field string, options FileOptions) error {
+	if field == "" {
+		if _, found := s[defaultSecretField]; found || len(s) != 1 {
+			field = defaultSecretField
+		} else {
+			for name := range s {
+				field = name
+			}
+		}
+	}
+	value, found := s[field]
+	if !found {
+		return maskAny(errgo.WithCausef(nil, SecretNotFoundError, "no field '%s' found in unwrapped secret", field))
+	}
+	if err := writeSecretFile(path, []byte(value), options); err != nil {
+		return maskAny(err)
+	}
+	return nil
+}
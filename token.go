@@ -51,6 +51,7 @@ func init() {
 	cmdTokenCreate.Flags().StringVar(&tokenFlags.role, "role", "", "If set, the token will be created against the given role")
 	cmdTokenCreate.Flags().StringVar(&tokenFlags.template, "template", "", "If set, the token will be wrapped in this Go text template (use {{.Token}})")
 	cmdTokenCreate.Flags().StringVar(&tokenFlags.wrapTTL, "wrap-ttl", "", "If set, the token will be wrapped for single use (cubbyhole) with this TTL")
+	addFileOptionsFlags(cmdTokenCreate.Flags())
 
 	cmdMain.AddCommand(cmdToken)
 }
@@ -58,6 +59,7 @@ func init() {
 func cmdTokenCreateRun(cmd *cobra.Command, args []string) {
 	assertArgIsSet(tokenFlags.path, "path")
 	assertArgIsSet(strings.Join(tokenFlags.policies, ","), "policy")
+	fileOptions := mustGetFileOptions()
 
 	c, _, err := serverLogin()
 	if err != nil {
@@ -69,7 +71,7 @@ func cmdTokenCreateRun(cmd *cobra.Command, args []string) {
 		Role:     tokenFlags.role,
 		Template: tokenFlags.template,
 		WrapTTL:  tokenFlags.wrapTTL,
-	}); err != nil {
+	}, fileOptions); err != nil {
 		Exitf("Failed to create token: %v", err)
 	}
 }
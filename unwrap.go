@@ -0,0 +1,100 @@
+// Copyright (c) 2016 Pulcy.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pulcy/vault-monkey/service"
+)
+
+var (
+	cmdUnwrap = &cobra.Command{
+		Use:   "unwrap",
+		Short: "Commands to unwrap a response-wrapped secret",
+		Run:   showUsage,
+	}
+
+	cmdUnwrapEnv = &cobra.Command{
+		Use:     "env",
+		Short:   "Unwrap a secret into an environment file.",
+		Example: "--token-file=<wrapping-token-path> --target=<file-path> [--format=<format>]",
+		Run:     cmdUnwrapEnvRun,
+	}
+
+	cmdUnwrapFile = &cobra.Command{
+		Use:     "file",
+		Short:   "Unwrap a secret into a file.",
+		Example: "--token-file=<wrapping-token-path> --target=<file-path> [--field=<field>]",
+		Run:     cmdUnwrapFileRun,
+	}
+
+	unwrapFlags struct {
+		tokenFilePath  string
+		targetFilePath string
+		field          string
+	}
+)
+
+func init() {
+	cmdUnwrap.PersistentFlags().StringVar(&unwrapFlags.tokenFilePath, "token-file", "", "Path of the file containing the wrapping token")
+	cmdUnwrap.PersistentFlags().StringVar(&unwrapFlags.targetFilePath, "target", "", "Path of target file")
+	addFileOptionsFlags(cmdUnwrap.PersistentFlags())
+	cmdUnwrapEnv.Flags().StringVar(&envFlags.format, "format", service.DefaultEnvFormatName, envFormatUsage())
+	cmdUnwrapFile.Flags().StringVar(&unwrapFlags.field, "field", "", "Field of the unwrapped secret to write (defaults to 'value' or the only field)")
+	cmdUnwrap.AddCommand(cmdUnwrapEnv)
+	cmdUnwrap.AddCommand(cmdUnwrapFile)
+	cmdMain.AddCommand(cmdUnwrap)
+}
+
+func cmdUnwrapEnvRun(cmd *cobra.Command, args []string) {
+	assertArgIsSet(unwrapFlags.targetFilePath, "--target")
+	format := mustGetEnvFormat()
+	fileOptions := mustGetFileOptions()
+	secret := mustUnwrap()
+	if err := secret.CreateEnvironmentFile(unwrapFlags.targetFilePath, format, fileOptions); err != nil {
+		Exitf("Failed to write unwrapped secret: %v", err)
+	}
+}
+
+func cmdUnwrapFileRun(cmd *cobra.Command, args []string) {
+	assertArgIsSet(unwrapFlags.targetFilePath, "--target")
+	fileOptions := mustGetFileOptions()
+	secret := mustUnwrap()
+	if err := secret.CreateSecretFile(unwrapFlags.targetFilePath, unwrapFlags.field, fileOptions); err != nil {
+		Exitf("Failed to write unwrapped secret: %v", err)
+	}
+}
+
+// mustUnwrap reads the wrapping token from the --token-file and unwraps it.
+func mustUnwrap() service.UnwrappedSecret {
+	assertArgIsSet(unwrapFlags.tokenFilePath, "--token-file")
+	raw, err := ioutil.ReadFile(unwrapFlags.tokenFilePath)
+	if err != nil {
+		Exitf("Cannot read wrapping token: %v", err)
+	}
+	vs, err := service.NewVaultService(log, globalFlags.VaultServiceConfig)
+	if err != nil {
+		Exitf("Failed to create vault service: %v", err)
+	}
+	secret, err := vs.Unwrap(strings.TrimSpace(string(raw)))
+	if err != nil {
+		Exitf("Unwrap failed: %v", err)
+	}
+	return secret
+}